@@ -0,0 +1,48 @@
+package mamoru
+
+import "github.com/ethereum/go-ethereum/rpc"
+
+// ControlAPI exposes a Controller over JSON-RPC, in the "mamoru" namespace:
+// mamoru_pause, mamoru_resume, mamoru_reconfigure and mamoru_status.
+type ControlAPI struct {
+	controller *Controller
+}
+
+// NewControlAPI returns the API of controller, DefaultController if nil.
+func NewControlAPI(controller *Controller) *ControlAPI {
+	if controller == nil {
+		controller = DefaultController
+	}
+	return &ControlAPI{controller: controller}
+}
+
+// APIs returns the RPC APIs of controller, to register with the node. As
+// the admin namespace, they are served over IPC, and over HTTP or WebSocket
+// only if "mamoru" is listed in --http.api or --ws.api.
+func APIs(controller *Controller) []rpc.API {
+	return []rpc.API{{
+		Namespace: "mamoru",
+		Service:   NewControlAPI(controller),
+	}}
+}
+
+// Pause stops the pipeline from sending blocks, from the next one.
+func (api *ControlAPI) Pause(pipeline string) error {
+	return api.controller.Pause(pipeline)
+}
+
+// Resume makes a paused pipeline send blocks again, from the next one.
+func (api *ControlAPI) Resume(pipeline string) error {
+	return api.controller.Resume(pipeline)
+}
+
+// Reconfigure replaces the tracer options and the filters of the pipeline
+// from the next block, a null config restores those of the config file.
+func (api *ControlAPI) Reconfigure(pipeline string, cfg *PipelineConfig) error {
+	return api.controller.Reconfigure(pipeline, cfg)
+}
+
+// Status returns the state of every pipeline.
+func (api *ControlAPI) Status() []PipelineStatus {
+	return api.controller.Status()
+}
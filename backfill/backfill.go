@@ -0,0 +1,208 @@
+// Package backfill sends the blocks the sniffer missed, e.g. while the node
+// was down or the sniffer disabled.
+package backfill
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/params"
+
+	mamoru "github.com/Mamoru-Foundation/geth-mamoru-core-sdk"
+	"github.com/Mamoru-Foundation/geth-mamoru-core-sdk/call_tracer"
+)
+
+// ErrSnifferUnavailable is returned by Run when the sniffer requirements are
+// not met, the blocks left are not sent.
+var ErrSnifferUnavailable = errors.New("sniffer is not enabled, connected or synced")
+
+// Options tune a Runner.
+type Options struct {
+	// Interval is the minimum time between two blocks, so that the backfill
+	// leaves room for the live sniffing. Unthrottled if zero.
+	Interval time.Duration
+	// Trace are the options blocks are traced with. Sharing the Pool of the
+	// live sniffing bounds the blocks traced at once by both.
+	Trace call_tracer.Options
+
+	ErrorRegistry mamoru.ErrorRegistry
+	WithStorage   bool
+	// Verify enables the check of every traced block against its header. A
+	// block that diverges is still sent, marked as diverged.
+	Verify bool
+}
+
+// Runner traces and sends a range of past blocks in order, tagged with
+// mamoru.CtxBackfill. The last block sent is saved to a checkpoint after
+// each block, so a Runner stopped at any point resumes after it.
+type Runner struct {
+	chain       Chain
+	chainConfig *params.ChainConfig
+	sniffer     *mamoru.Sniffer
+	checkpoint  Checkpoint
+	options     Options
+
+	send func(tracer *mamoru.Tracer, block *types.Block, start time.Time, snifferContext string) error
+}
+
+// NewRunner returns a Runner reading blocks from chain. Without a sniffer,
+// a new one is made.
+func NewRunner(chain Chain, chainConfig *params.ChainConfig, sniffer *mamoru.Sniffer, checkpoint Checkpoint, opts Options) *Runner {
+	if sniffer == nil {
+		sniffer = mamoru.NewSniffer()
+	}
+	return &Runner{
+		chain:       chain,
+		chainConfig: chainConfig,
+		sniffer:     sniffer,
+		checkpoint:  checkpoint,
+		options:     opts,
+		send: func(tracer *mamoru.Tracer, block *types.Block, start time.Time, snifferContext string) error {
+			return tracer.Send(start, block.Number(), block.Hash(), snifferContext)
+		},
+	}
+}
+
+// Run sends the blocks from to to, both included, skipping those up to the
+// checkpoint. It returns when the range is done, on the first block that
+// fails to be traced or that the sink fails to take, or when ctx is
+// cancelled; in every case the checkpoint holds the last block delivered.
+func (r *Runner) Run(ctx context.Context, from, to uint64) error {
+	if from > to {
+		return fmt.Errorf("invalid range [%d, %d]", from, to)
+	}
+	progress, err := r.checkpoint.Load()
+	if err != nil {
+		return fmt.Errorf("load checkpoint: %w", err)
+	}
+	if progress != nil && progress.Number >= from {
+		from = progress.Number + 1
+	}
+	if from > to {
+		return nil
+	}
+	log.Info("Mamoru backfill start", "from", from, "to", to, "ctx", mamoru.CtxBackfill)
+	if err := r.run(ctx, from, to, r.checkpoint.Save); err != nil {
+		return err
+	}
+	log.Info("Mamoru backfill finish", "from", from, "to", to, "ctx", mamoru.CtxBackfill)
+
+	return nil
+}
+
+// run sends the blocks from to to in order and passes each one delivered
+// to delivered, stopping on the first error.
+func (r *Runner) run(ctx context.Context, from, to uint64, delivered func(Progress) error) error {
+	var throttle <-chan time.Time
+	if r.options.Interval > 0 {
+		ticker := time.NewTicker(r.options.Interval)
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+	for number := from; number <= to; number++ {
+		if throttle != nil && number > from {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-throttle:
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !r.sniffer.CheckRequirements() || !r.sniffer.ContextEnabled(mamoru.CtxBackfill) {
+			return ErrSnifferUnavailable
+		}
+		block, err := r.chain.BlockByNumber(ctx, number)
+		if err == nil {
+			err = r.processBlock(ctx, block, mamoru.CtxBackfill, (*mamoru.Tracer).SetBackfillCtx)
+		}
+		if err != nil {
+			return fmt.Errorf("backfill block %d: %w", number, err)
+		}
+		if err := delivered(Progress{Number: number, Hash: block.Hash()}); err != nil {
+			return fmt.Errorf("save checkpoint: %w", err)
+		}
+	}
+	return nil
+}
+
+// processBlock traces and sends block, tagged by tag. A block that can't be
+// traced is still sent, marked incomplete. It fails if the block is not
+// delivered.
+func (r *Runner) processBlock(ctx context.Context, block *types.Block, snifferContext string, tag func(*mamoru.Tracer)) error {
+	startTime := time.Now()
+	number := block.NumberU64()
+	log.Info("Mamoru block resend start", "number", number, "hash", block.Hash(), "ctx", snifferContext)
+
+	receipts, err := r.chain.BlockReceipts(ctx, block)
+	if err != nil {
+		return err
+	}
+
+	tracer := mamoru.NewTracer(mamoru.NewFeed(r.chainConfig, mamoru.WithChain(r.chain)), mamoru.WithTracerConfig(r.sniffer.Config()))
+	tracer.SetSink(r.sniffer.Sink())
+	tag(tracer)
+
+	if number > 0 {
+		results, err := r.traceBlock(ctx, tracer, block, receipts, snifferContext)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			log.Error("Mamoru block resend trace", "number", number, "err", err, "ctx", snifferContext)
+			tracer.MarkIncomplete(err.Error())
+		}
+		for _, txErr := range call_tracer.TraceErrors(results) {
+			tracer.MarkIncomplete(txErr.Error())
+		}
+		for _, call := range results {
+			tracer.FeedCalTraces(call.Result, number)
+			if call.StateDiff != nil {
+				tracer.FeedStateDiffs([]*mamoru.TxStateDiff{call.StateDiff}, number)
+			}
+		}
+	}
+
+	tracer.FeedBlock(block, receipts)
+	tracer.FeedTransactions(block.Number(), block.Time(), block.BaseFee(), block.Transactions(), receipts)
+	tracer.FeedEvents(receipts)
+	tracer.FeedWithdrawals(block.Withdrawals(), number)
+
+	return r.send(tracer, block, startTime, snifferContext)
+}
+
+func (r *Runner) traceBlock(ctx context.Context, tracer *mamoru.Tracer, block *types.Block, receipts types.Receipts, snifferContext string) ([]*call_tracer.TxTraceResult, error) {
+	parent := r.chain.GetHeader(block.ParentHash(), block.NumberU64()-1)
+	if parent == nil {
+		return nil, fmt.Errorf("parent of block %d not found", block.NumberU64())
+	}
+	stateDb, err := r.chain.StateAt(ctx, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	traceOptions := r.options.Trace
+	if r.options.Verify {
+		onDivergence := traceOptions.OnDivergence
+		traceOptions.OnDivergence = func(divergence *call_tracer.Divergence) {
+			log.Warn("Mamoru block diverges", "number", divergence.BlockNumber, "hash", divergence.BlockHash,
+				"tx", divergence.TxIndex, "reason", divergence.Reason, "ctx", snifferContext)
+			tracer.MarkDiverged(divergence.String())
+			if onDivergence != nil {
+				onDivergence(divergence)
+			}
+		}
+	}
+	traceConfig := call_tracer.NewTracerConfig(stateDb, r.chainConfig, r.chain).
+		WithErrorRegistry(r.options.ErrorRegistry).
+		WithStorage(r.options.WithStorage).
+		WithOptions(traceOptions).
+		WithReceipts(receipts)
+
+	return call_tracer.TraceBlock(ctx, traceConfig, block)
+}
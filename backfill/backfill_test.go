@@ -0,0 +1,414 @@
+package backfill
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Mamoru-Foundation/mamoru-sniffer-go/mamoru_sniffer"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	mamoru "github.com/Mamoru-Foundation/geth-mamoru-core-sdk"
+)
+
+func newTestChain(t *testing.T, n int) *core.BlockChain {
+	chain, _ := newTestChainWithDB(t, n)
+	return chain
+}
+
+// newTestChainWithDB also returns the database with the states of the
+// blocks, to generate forks from.
+func newTestChainWithDB(t *testing.T, n int) (*core.BlockChain, ethdb.Database) {
+	key, _ := crypto.GenerateKey()
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+	genesis := &core.Genesis{
+		Config:  params.TestChainConfig,
+		Alloc:   core.GenesisAlloc{sender: {Balance: big.NewInt(params.Ether)}},
+		BaseFee: big.NewInt(params.InitialBaseFee),
+	}
+	signer := types.LatestSigner(params.TestChainConfig)
+	db, blocks, _ := core.GenerateChainWithGenesis(genesis, ethash.NewFaker(), n, func(i int, gen *core.BlockGen) {
+		tx, err := types.SignNewTx(key, signer, &types.LegacyTx{
+			Nonce:    gen.TxNonce(sender),
+			To:       &common.Address{0xaa},
+			Value:    big.NewInt(1),
+			Gas:      params.TxGas,
+			GasPrice: gen.BaseFee(),
+		})
+		require.NoError(t, err)
+		gen.AddTx(tx)
+	})
+	chain, err := core.NewBlockChain(rawdb.NewMemoryDatabase(), nil, genesis, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	require.NoError(t, err)
+	t.Cleanup(chain.Stop)
+	_, err = chain.InsertChain(blocks)
+	require.NoError(t, err)
+	return chain, db
+}
+
+func enableSniffer(t *testing.T) {
+	t.Setenv("MAMORU_SNIFFER_ENABLE", "true")
+	connect := mamoru.SnifferConnectFunc
+	mamoru.SnifferConnectFunc = func() (*mamoru_sniffer.Sniffer, error) { return nil, nil }
+	t.Cleanup(func() { mamoru.SnifferConnectFunc = connect })
+}
+
+type sent struct {
+	number     uint64
+	incomplete []string
+}
+
+func newTestRunner(chain *core.BlockChain, checkpoint Checkpoint, opts Options, onSend func(*mamoru.Tracer, *types.Block)) *Runner {
+	runner := NewRunner(FullChain(chain), chain.Config(), nil, checkpoint, opts)
+	runner.send = func(tracer *mamoru.Tracer, block *types.Block, _ time.Time, _ string) error {
+		onSend(tracer, block)
+		return nil
+	}
+	return runner
+}
+
+func TestRunner_Run(t *testing.T) {
+	enableSniffer(t)
+	chain := newTestChain(t, 5)
+	checkpoint := NewFileCheckpoint(filepath.Join(t.TempDir(), "backfill.json"))
+
+	var blocks []sent
+	runner := newTestRunner(chain, checkpoint, Options{Verify: true}, func(tracer *mamoru.Tracer, block *types.Block) {
+		blocks = append(blocks, sent{block.NumberU64(), tracer.Incomplete()})
+		assert.Empty(t, tracer.Diverged())
+		assert.Equal(t, mamoru.BlockStatusBackfill, tracer.Status())
+	})
+	require.NoError(t, runner.Run(context.Background(), 1, 5))
+
+	require.Len(t, blocks, 5)
+	for i, block := range blocks {
+		assert.Equal(t, uint64(i+1), block.number)
+		assert.Empty(t, block.incomplete)
+	}
+	progress, err := checkpoint.Load()
+	require.NoError(t, err)
+	assert.Equal(t, &Progress{Number: 5, Hash: chain.GetBlockByNumber(5).Hash()}, progress)
+
+	// Done already
+	require.NoError(t, runner.Run(context.Background(), 1, 5))
+	assert.Len(t, blocks, 5)
+}
+
+func TestRunner_Resume(t *testing.T) {
+	enableSniffer(t)
+	chain := newTestChain(t, 5)
+	checkpoint := NewFileCheckpoint(filepath.Join(t.TempDir(), "backfill.json"))
+
+	// Stopped right after sending block 3
+	ctx, cancel := context.WithCancel(context.Background())
+	var numbers []uint64
+	runner := newTestRunner(chain, checkpoint, Options{}, func(_ *mamoru.Tracer, block *types.Block) {
+		numbers = append(numbers, block.NumberU64())
+		if block.NumberU64() == 3 {
+			cancel()
+		}
+	})
+	assert.ErrorIs(t, runner.Run(ctx, 1, 5), context.Canceled)
+	assert.Equal(t, []uint64{1, 2, 3}, numbers)
+
+	numbers = nil
+	runner = newTestRunner(chain, checkpoint, Options{}, func(_ *mamoru.Tracer, block *types.Block) {
+		numbers = append(numbers, block.NumberU64())
+	})
+	require.NoError(t, runner.Run(context.Background(), 1, 5))
+	assert.Equal(t, []uint64{4, 5}, numbers)
+}
+
+func TestRunner_SendFails(t *testing.T) {
+	enableSniffer(t)
+	chain := newTestChain(t, 3)
+	checkpoint := NewFileCheckpoint(filepath.Join(t.TempDir(), "backfill.json"))
+
+	runner := newTestRunner(chain, checkpoint, Options{}, nil)
+	var numbers []uint64
+	runner.send = func(_ *mamoru.Tracer, block *types.Block, _ time.Time, _ string) error {
+		if block.NumberU64() == 2 {
+			return mamoru.ErrNotConnected
+		}
+		numbers = append(numbers, block.NumberU64())
+		return nil
+	}
+	assert.ErrorIs(t, runner.Run(context.Background(), 1, 3), mamoru.ErrNotConnected)
+	assert.Equal(t, []uint64{1}, numbers)
+
+	// The block not delivered is not checkpointed
+	progress, err := checkpoint.Load()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), progress.Number)
+}
+
+func TestRunner_Throttle(t *testing.T) {
+	enableSniffer(t)
+	chain := newTestChain(t, 3)
+	checkpoint := NewFileCheckpoint(filepath.Join(t.TempDir(), "backfill.json"))
+
+	var count int
+	runner := newTestRunner(chain, checkpoint, Options{Interval: 50 * time.Millisecond}, func(*mamoru.Tracer, *types.Block) {
+		count++
+	})
+	start := time.Now()
+	require.NoError(t, runner.Run(context.Background(), 1, 3))
+	assert.Equal(t, 3, count)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestRunner_SnifferUnavailable(t *testing.T) {
+	t.Setenv("MAMORU_SNIFFER_ENABLE", "false")
+	chain := newTestChain(t, 1)
+	checkpoint := NewFileCheckpoint(filepath.Join(t.TempDir(), "backfill.json"))
+
+	runner := newTestRunner(chain, checkpoint, Options{}, func(*mamoru.Tracer, *types.Block) {
+		t.Fatal("block sent")
+	})
+	assert.ErrorIs(t, runner.Run(context.Background(), 1, 1), ErrSnifferUnavailable)
+	progress, err := checkpoint.Load()
+	require.NoError(t, err)
+	assert.Nil(t, progress)
+}
+
+func TestFileCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	checkpoint := NewFileCheckpoint(filepath.Join(dir, "backfill.json"))
+
+	progress, err := checkpoint.Load()
+	require.NoError(t, err)
+	assert.Nil(t, progress)
+
+	require.NoError(t, checkpoint.Save(Progress{Number: 7, Hash: common.Hash{0x07}}))
+	require.NoError(t, checkpoint.Save(Progress{Number: 8, Hash: common.Hash{0x08}}))
+
+	progress, err = NewFileCheckpoint(filepath.Join(dir, "backfill.json")).Load()
+	require.NoError(t, err)
+	assert.Equal(t, &Progress{Number: 8, Hash: common.Hash{0x08}}, progress)
+
+	// No temporary file left behind
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestTracker(t *testing.T) {
+	enableSniffer(t)
+	chain := newTestChain(t, 12)
+	checkpoint := NewFileCheckpoint(filepath.Join(t.TempDir(), "delivered.json"))
+	header := func(number uint64) *types.Header {
+		return chain.GetHeaderByNumber(number)
+	}
+
+	var numbers []uint64
+	tracker := NewTracker(newTestRunner(chain, checkpoint, Options{}, func(_ *mamoru.Tracer, block *types.Block) {
+		numbers = append(numbers, block.NumberU64())
+	}), 3)
+	ctx := context.Background()
+	delivered := func() uint64 {
+		progress, err := checkpoint.Load()
+		require.NoError(t, err)
+		return progress.Number
+	}
+	catchUp := func(number uint64) {
+		tracker.CatchUp(ctx, header(number))
+		tracker.Wait()
+	}
+
+	// Nothing to catch up on before the first head
+	catchUp(1)
+	require.NoError(t, tracker.Done(header(1), true))
+	assert.Empty(t, numbers)
+	assert.Equal(t, uint64(1), delivered())
+
+	// Head 2 failed to be sent
+	catchUp(2)
+	require.NoError(t, tracker.Done(header(2), false))
+	assert.Equal(t, uint64(1), delivered())
+
+	catchUp(4)
+	require.NoError(t, tracker.Done(header(4), true))
+	assert.Equal(t, []uint64{2, 3}, numbers)
+	assert.Equal(t, uint64(4), delivered())
+
+	// Only the last 3 blocks of the gap
+	numbers = nil
+	catchUp(10)
+	require.NoError(t, tracker.Done(header(10), true))
+	assert.Equal(t, []uint64{7, 8, 9}, numbers)
+	assert.Equal(t, uint64(10), delivered())
+
+	// Head 11 is in flight while head 12 arrives
+	numbers = nil
+	catchUp(11)
+	catchUp(12)
+	require.NoError(t, tracker.Done(header(12), true))
+	assert.Equal(t, uint64(10), delivered())
+	require.NoError(t, tracker.Done(header(11), true))
+	assert.Empty(t, numbers)
+	assert.Equal(t, uint64(12), delivered())
+}
+
+func TestTracker_HeadInFlight(t *testing.T) {
+	enableSniffer(t)
+	chain := newTestChain(t, 9)
+	checkpoint := NewFileCheckpoint(filepath.Join(t.TempDir(), "delivered.json"))
+	require.NoError(t, checkpoint.Save(Progress{Number: 2}))
+	header := func(number uint64) *types.Header {
+		return chain.GetHeaderByNumber(number)
+	}
+
+	var (
+		numbers []uint64
+		sending = make(chan uint64)
+		release = make(chan struct{})
+	)
+	tracker := NewTracker(newTestRunner(chain, checkpoint, Options{}, func(_ *mamoru.Tracer, block *types.Block) {
+		sending <- block.NumberU64()
+		<-release
+		numbers = append(numbers, block.NumberU64())
+	}), 0)
+	ctx := context.Background()
+	delivered := func() uint64 {
+		progress, err := checkpoint.Load()
+		require.NoError(t, err)
+		return progress.Number
+	}
+
+	// Head 4 is in flight, 3 and 5 to 7 are missed
+	tracker.CatchUp(ctx, header(4))
+	tracker.CatchUp(ctx, header(8))
+	for _, number := range []uint64{3, 5} {
+		assert.Equal(t, number, <-sending)
+		// The heads go on while a block is traced
+		if number == 5 {
+			require.NoError(t, tracker.Done(header(8), true))
+		}
+		release <- struct{}{}
+	}
+	for range []uint64{6, 7} {
+		<-sending
+		release <- struct{}{}
+	}
+	tracker.Wait()
+	assert.Equal(t, []uint64{3, 5, 6, 7}, numbers)
+	// Not past the head in flight
+	assert.Equal(t, uint64(3), delivered())
+
+	// Head 4 failed, the next catch-up sends it
+	require.NoError(t, tracker.Done(header(4), false))
+	assert.Equal(t, uint64(3), delivered())
+	go func() {
+		assert.Equal(t, uint64(4), <-sending)
+		release <- struct{}{}
+	}()
+	tracker.CatchUp(ctx, header(9))
+	tracker.Wait()
+	assert.Equal(t, uint64(8), delivered())
+}
+
+func TestReorgHandler(t *testing.T) {
+	enableSniffer(t)
+	chain, db := newTestChainWithDB(t, 5)
+	oldHead := chain.CurrentBlock()
+
+	// A longer fork from block 2
+	forkBlocks, _ := core.GenerateChain(chain.Config(), chain.GetBlockByNumber(2), ethash.NewFaker(), db, 4,
+		func(i int, gen *core.BlockGen) {
+			gen.SetCoinbase(common.Address{0xfe})
+		})
+	_, err := chain.InsertChain(forkBlocks)
+	require.NoError(t, err)
+	newHead := chain.CurrentBlock()
+	require.Equal(t, forkBlocks[3].Hash(), newHead.Hash())
+
+	type notice struct {
+		number uint64
+		status string
+	}
+	var notices []notice
+	handler := NewReorgHandler(newTestRunner(chain, NewFileCheckpoint(filepath.Join(t.TempDir(), "unused.json")), Options{},
+		func(tracer *mamoru.Tracer, block *types.Block) {
+			notices = append(notices, notice{block.NumberU64(), tracer.Status()})
+		}), 0)
+
+	reorg, err := handler.Handle(context.Background(), oldHead, newHead)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), reorg.Depth())
+	require.Len(t, reorg.Added, 4)
+	assert.Equal(t, uint64(3), reorg.Added[0].Number.Uint64())
+
+	assert.Equal(t, []notice{
+		{5, "retracted,reorg=3"},
+		{4, "retracted,reorg=3"},
+		{3, "retracted,reorg=3"},
+		{3, "reorg=3"},
+		{4, "reorg=3"},
+		{5, "reorg=3"},
+	}, notices)
+
+	// A head extending the previous one is no reorg
+	notices = nil
+	reorg, err = handler.Handle(context.Background(), chain.GetHeaderByNumber(4), newHead)
+	require.NoError(t, err)
+	assert.Zero(t, reorg.Depth())
+	assert.Empty(t, notices)
+
+	_, err = FindReorg(FullChain(chain), oldHead, newHead, 2)
+	assert.Error(t, err)
+}
+
+func TestReorgHandler_Submit(t *testing.T) {
+	enableSniffer(t)
+	chain, db := newTestChainWithDB(t, 4)
+	oldHead := chain.CurrentBlock()
+
+	// A longer fork from block 3
+	forkBlocks, _ := core.GenerateChain(chain.Config(), chain.GetBlockByNumber(3), ethash.NewFaker(), db, 2,
+		func(i int, gen *core.BlockGen) {
+			gen.SetCoinbase(common.Address{0xfe})
+		})
+	_, err := chain.InsertChain(forkBlocks)
+	require.NoError(t, err)
+	newHead := chain.CurrentBlock()
+
+	var statuses []string
+	handler := NewReorgHandler(newTestRunner(chain, NewFileCheckpoint(filepath.Join(t.TempDir(), "unused.json")), Options{},
+		func(tracer *mamoru.Tracer, block *types.Block) {
+			statuses = append(statuses, fmt.Sprintf("%d %s %x", block.NumberU64(), tracer.Status(), block.Hash().Bytes()[:2]))
+		}), 0)
+	defer handler.Close()
+
+	// Two reorgs close together, back and forth, are sent in order
+	reorg, err := handler.Submit(oldHead, newHead)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), reorg.Depth())
+	reorg, err = handler.Submit(newHead, oldHead)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), reorg.Depth())
+	handler.Wait()
+
+	short := func(header *types.Header) string {
+		return fmt.Sprintf("%x", header.Hash().Bytes()[:2])
+	}
+	assert.Equal(t, []string{
+		"4 retracted,reorg=1 " + short(oldHead),
+		"4 reorg=1 " + short(forkBlocks[0].Header()),
+		"5 retracted,reorg=2 " + short(newHead),
+		"4 retracted,reorg=2 " + short(forkBlocks[0].Header()),
+	}, statuses)
+}
@@ -0,0 +1,111 @@
+package backfill
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/light"
+)
+
+// Chain is the chain a Runner reads the blocks to backfill from.
+type Chain interface {
+	core.ChainContext
+	// A header reader lets the engine credit the block rewards when a block
+	// is verified.
+	consensus.ChainHeaderReader
+
+	// BlockByNumber returns the canonical block at number.
+	BlockByNumber(ctx context.Context, number uint64) (*types.Block, error)
+	// BlockByHash returns the block of hash at number, canonical or not.
+	BlockByHash(ctx context.Context, hash common.Hash, number uint64) (*types.Block, error)
+	// BlockReceipts returns the receipts of block.
+	BlockReceipts(ctx context.Context, block *types.Block) (types.Receipts, error)
+	// StateAt returns the state after the block of header.
+	StateAt(ctx context.Context, header *types.Header) (*state.StateDB, error)
+}
+
+type fullBlockChain interface {
+	core.ChainContext
+	consensus.ChainHeaderReader
+	GetBlockByNumber(number uint64) *types.Block
+	GetBlock(hash common.Hash, number uint64) *types.Block
+	GetReceiptsByHash(hash common.Hash) types.Receipts
+	StateAt(root common.Hash) (*state.StateDB, error)
+}
+
+type fullChain struct {
+	fullBlockChain
+}
+
+// FullChain adapts a *core.BlockChain. Blocks whose parent state was pruned
+// can't be traced, they are sent incomplete.
+func FullChain(bc fullBlockChain) Chain {
+	return fullChain{bc}
+}
+
+func (c fullChain) BlockByNumber(_ context.Context, number uint64) (*types.Block, error) {
+	block := c.GetBlockByNumber(number)
+	if block == nil {
+		return nil, fmt.Errorf("block %d not found", number)
+	}
+	return block, nil
+}
+
+func (c fullChain) BlockByHash(_ context.Context, hash common.Hash, number uint64) (*types.Block, error) {
+	block := c.GetBlock(hash, number)
+	if block == nil {
+		return nil, fmt.Errorf("block %d (%s) not found", number, hash)
+	}
+	return block, nil
+}
+
+func (c fullChain) BlockReceipts(_ context.Context, block *types.Block) (types.Receipts, error) {
+	receipts := c.GetReceiptsByHash(block.Hash())
+	if receipts == nil && len(block.Transactions()) > 0 {
+		return nil, fmt.Errorf("receipts of block %d not found", block.NumberU64())
+	}
+	return receipts, nil
+}
+
+func (c fullChain) StateAt(_ context.Context, header *types.Header) (*state.StateDB, error) {
+	return c.fullBlockChain.StateAt(header.Root)
+}
+
+type lightBlockChain interface {
+	core.ChainContext
+	consensus.ChainHeaderReader
+	GetBlockByNumber(ctx context.Context, number uint64) (*types.Block, error)
+	GetBlock(ctx context.Context, hash common.Hash, number uint64) (*types.Block, error)
+	Odr() light.OdrBackend
+}
+
+type lightChain struct {
+	lightBlockChain
+}
+
+// LightChain adapts a *light.LightChain. Blocks, receipts and state are
+// retrieved on demand from the ODR backend.
+func LightChain(lc lightBlockChain) Chain {
+	return lightChain{lc}
+}
+
+func (c lightChain) BlockByNumber(ctx context.Context, number uint64) (*types.Block, error) {
+	return c.GetBlockByNumber(ctx, number)
+}
+
+func (c lightChain) BlockByHash(ctx context.Context, hash common.Hash, number uint64) (*types.Block, error) {
+	return c.GetBlock(ctx, hash, number)
+}
+
+func (c lightChain) BlockReceipts(ctx context.Context, block *types.Block) (types.Receipts, error) {
+	return light.GetBlockReceipts(ctx, c.Odr(), block.Hash(), block.NumberU64())
+}
+
+func (c lightChain) StateAt(ctx context.Context, header *types.Header) (*state.StateDB, error) {
+	return light.NewState(ctx, header, c.Odr()), nil
+}
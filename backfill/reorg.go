@@ -0,0 +1,236 @@
+package backfill
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+
+	mamoru "github.com/Mamoru-Foundation/geth-mamoru-core-sdk"
+)
+
+// DefaultMaxReorgDepth is the default number of blocks a ReorgHandler walks
+// back to find the common ancestor of two heads.
+const DefaultMaxReorgDepth = 128
+
+// Reorg is a change of the canonical chain from one head to another.
+type Reorg struct {
+	Dropped []*types.Header // Blocks of the old chain, newest first
+	Added   []*types.Header // Blocks of the new chain, oldest first
+}
+
+// Depth is the number of blocks the reorg dropped.
+func (r *Reorg) Depth() uint64 {
+	return uint64(len(r.Dropped))
+}
+
+// FindReorg walks oldHead and newHead back to their common ancestor, at
+// most maxDepth blocks each. The reorg has no dropped blocks if newHead
+// extends oldHead.
+func FindReorg(chain Chain, oldHead, newHead *types.Header, maxDepth uint64) (*Reorg, error) {
+	var (
+		reorg                = new(Reorg)
+		oldHeader, newHeader = oldHead, newHead
+	)
+	parent := func(header *types.Header) (*types.Header, error) {
+		if uint64(len(reorg.Dropped)) > maxDepth || uint64(len(reorg.Added)) > maxDepth {
+			return nil, fmt.Errorf("no common ancestor of %d (%s) and %d (%s) within %d blocks",
+				oldHead.Number, oldHead.Hash(), newHead.Number, newHead.Hash(), maxDepth)
+		}
+		if header.Number.Sign() == 0 {
+			return nil, fmt.Errorf("no common ancestor of %s and %s", oldHead.Hash(), newHead.Hash())
+		}
+		p := chain.GetHeader(header.ParentHash, header.Number.Uint64()-1)
+		if p == nil {
+			return nil, fmt.Errorf("parent of block %d (%s) not found", header.Number, header.Hash())
+		}
+		return p, nil
+	}
+
+	var err error
+	for oldHeader.Number.Cmp(newHeader.Number) > 0 {
+		reorg.Dropped = append(reorg.Dropped, oldHeader)
+		if oldHeader, err = parent(oldHeader); err != nil {
+			return nil, err
+		}
+	}
+	for newHeader.Number.Cmp(oldHeader.Number) > 0 {
+		reorg.Added = append(reorg.Added, newHeader)
+		if newHeader, err = parent(newHeader); err != nil {
+			return nil, err
+		}
+	}
+	for oldHeader.Hash() != newHeader.Hash() {
+		reorg.Dropped = append(reorg.Dropped, oldHeader)
+		reorg.Added = append(reorg.Added, newHeader)
+		if oldHeader, err = parent(oldHeader); err != nil {
+			return nil, err
+		}
+		if newHeader, err = parent(newHeader); err != nil {
+			return nil, err
+		}
+	}
+	for i, j := 0, len(reorg.Added)-1; i < j; i, j = i+1, j-1 {
+		reorg.Added[i], reorg.Added[j] = reorg.Added[j], reorg.Added[i]
+	}
+	return reorg, nil
+}
+
+// ReorgHandler sends the changes of the canonical chain: a retraction notice
+// for each dropped block, newest first, then the added blocks, oldest first,
+// all tagged with the depth of the reorg.
+type ReorgHandler struct {
+	runner   *Runner
+	maxDepth uint64
+
+	mu sync.Mutex // Keeps the notices of successive reorgs in order
+
+	queueMu sync.Mutex
+	queue   []queuedReorg // Reorgs submitted and not sent yet, oldest first
+	running bool          // Whether the queue is being sent
+	wg      sync.WaitGroup
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+type queuedReorg struct {
+	reorg            *Reorg
+	oldHead, newHead *types.Header
+}
+
+// NewReorgHandler returns a ReorgHandler sending the blocks with runner and
+// giving up on reorgs deeper than maxDepth, or DefaultMaxReorgDepth if
+// maxDepth is zero.
+func NewReorgHandler(runner *Runner, maxDepth uint64) *ReorgHandler {
+	if maxDepth == 0 {
+		maxDepth = DefaultMaxReorgDepth
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ReorgHandler{runner: runner, maxDepth: maxDepth, ctx: ctx, cancel: cancel}
+}
+
+// Handle sends the reorg from oldHead to newHead, if newHead doesn't extend
+// oldHead. newHead itself is left to the live pipeline, which should tag it
+// with the depth of the returned reorg through Tracer.SetReorgDepth.
+func (h *ReorgHandler) Handle(ctx context.Context, oldHead, newHead *types.Header) (*Reorg, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	reorg, err := FindReorg(h.runner.chain, oldHead, newHead, h.maxDepth)
+	if err != nil || len(reorg.Dropped) == 0 {
+		return reorg, err
+	}
+	return reorg, h.send(ctx, reorg, oldHead, newHead)
+}
+
+// Submit finds the reorg from oldHead to newHead, if newHead doesn't extend
+// oldHead, and queues its sending without waiting for it: the reorgs
+// submitted are sent in the background one at a time, in order, after the
+// ones Handle is sending. It suits the head changes of the live pipeline,
+// which tags newHead with the depth of the returned reorg.
+func (h *ReorgHandler) Submit(oldHead, newHead *types.Header) (*Reorg, error) {
+	reorg, err := FindReorg(h.runner.chain, oldHead, newHead, h.maxDepth)
+	if err != nil || len(reorg.Dropped) == 0 {
+		return reorg, err
+	}
+	h.queueMu.Lock()
+	defer h.queueMu.Unlock()
+	h.queue = append(h.queue, queuedReorg{reorg: reorg, oldHead: oldHead, newHead: newHead})
+	if !h.running {
+		h.running = true
+		h.wg.Add(1)
+		go h.drain()
+	}
+	return reorg, nil
+}
+
+// Wait blocks until the reorgs submitted are sent.
+func (h *ReorgHandler) Wait() {
+	h.wg.Wait()
+}
+
+// Close stops sending the reorgs submitted and waits for the one in
+// progress to stop.
+func (h *ReorgHandler) Close() {
+	h.cancel()
+	h.wg.Wait()
+}
+
+// drain sends the queued reorgs until there are none left.
+func (h *ReorgHandler) drain() {
+	defer h.wg.Done()
+	for {
+		h.queueMu.Lock()
+		if len(h.queue) == 0 || h.ctx.Err() != nil {
+			h.queue = nil
+			h.running = false
+			h.queueMu.Unlock()
+			return
+		}
+		next := h.queue[0]
+		h.queue = h.queue[1:]
+		h.queueMu.Unlock()
+
+		h.mu.Lock()
+		err := h.send(h.ctx, next.reorg, next.oldHead, next.newHead)
+		h.mu.Unlock()
+		if err != nil {
+			log.Error("Mamoru reorg", "number", next.newHead.Number, "hash", next.newHead.Hash(), "err", err, "ctx", mamoru.CtxReorg)
+		}
+	}
+}
+
+// send sends the dropped and the added blocks of reorg, but newHead.
+func (h *ReorgHandler) send(ctx context.Context, reorg *Reorg, oldHead, newHead *types.Header) error {
+	depth := reorg.Depth()
+	log.Warn("Mamoru chain reorg", "depth", depth, "dropped", len(reorg.Dropped), "added", len(reorg.Added),
+		"old", oldHead.Hash(), "new", newHead.Hash(), "ctx", mamoru.CtxReorg)
+
+	for _, header := range reorg.Dropped {
+		if err := h.retract(ctx, header, depth); err != nil {
+			return fmt.Errorf("retract block %d: %w", header.Number, err)
+		}
+	}
+	tag := func(tracer *mamoru.Tracer) {
+		tracer.SetReorgDepth(depth)
+	}
+	for _, header := range reorg.Added {
+		if header.Hash() == newHead.Hash() {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		block, err := h.runner.chain.BlockByHash(ctx, header.Hash(), header.Number.Uint64())
+		if err == nil {
+			err = h.runner.processBlock(ctx, block, mamoru.CtxReorg, tag)
+		}
+		if err != nil {
+			return fmt.Errorf("send block %d: %w", header.Number, err)
+		}
+	}
+	return nil
+}
+
+// retract sends the retraction notice of a dropped block: the block alone,
+// without its transactions and traces.
+func (h *ReorgHandler) retract(ctx context.Context, header *types.Header, depth uint64) error {
+	startTime := time.Now()
+	block, err := h.runner.chain.BlockByHash(ctx, header.Hash(), header.Number.Uint64())
+	if err != nil {
+		return err
+	}
+	// The receipts only refine the block reward, a dropped block may have none
+	receipts, _ := h.runner.chain.BlockReceipts(ctx, block)
+
+	tracer := mamoru.NewTracer(mamoru.NewFeed(h.runner.chainConfig, mamoru.WithChain(h.runner.chain)),
+		mamoru.WithTracerConfig(h.runner.sniffer.Config()))
+	tracer.SetSink(h.runner.sniffer.Sink())
+	tracer.MarkRetracted()
+	tracer.SetReorgDepth(depth)
+	tracer.FeedBlock(block, receipts)
+	return h.runner.send(tracer, block, startTime, mamoru.CtxReorg)
+}
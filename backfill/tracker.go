@@ -0,0 +1,240 @@
+package backfill
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+
+	mamoru "github.com/Mamoru-Foundation/geth-mamoru-core-sdk"
+)
+
+// DefaultMaxGap is the default number of missed blocks a Tracker catches up
+// on. It matches the number of recent states a full node keeps in memory.
+const DefaultMaxGap = 128
+
+// Tracker remembers the highest block the live sniffing delivered, in the
+// checkpoint of its Runner, and sends the blocks it skipped, e.g. while the
+// sniffer requirements briefly failed. The live pipeline calls CatchUp
+// before sending a head and Done after.
+//
+// The checkpoint only moves over blocks delivered without a hole, so it
+// stays below the lowest head in flight or not delivered, whatever order
+// the heads and the missed blocks are delivered in.
+type Tracker struct {
+	runner *Runner
+	maxGap uint64
+
+	mu        sync.Mutex
+	pending   map[uint64]int         // Heads between CatchUp and Done
+	delivered map[uint64]common.Hash // Blocks delivered above the checkpoint
+	floor     uint64                 // Highest block given up on, over the cap
+	head      uint64                 // Highest head passed to CatchUp
+	running   bool                   // Whether a catch-up is in progress
+	wg        sync.WaitGroup
+}
+
+// NewTracker returns a Tracker sending the missed blocks with runner, at
+// most maxGap of them before a head, or DefaultMaxGap if maxGap is zero.
+func NewTracker(runner *Runner, maxGap uint64) *Tracker {
+	if maxGap == 0 {
+		maxGap = DefaultMaxGap
+	}
+	return &Tracker{
+		runner:    runner,
+		maxGap:    maxGap,
+		pending:   make(map[uint64]int),
+		delivered: make(map[uint64]common.Hash),
+	}
+}
+
+// CatchUp starts sending the blocks between the highest one delivered and
+// head in the background, oldest first and tagged as backfilled, and
+// returns. ctx bounds the catch-up it starts. The blocks of a gap over the
+// cap are skipped, the oldest first. Nothing is sent before the first head
+// delivered. Heads passed to CatchUp and not to Done yet are in flight and
+// not counted as missed. One catch-up runs at a time, it takes in the
+// heads passed while it runs.
+func (t *Tracker) CatchUp(ctx context.Context, head *types.Header) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	number := head.Number.Uint64()
+	t.pending[number]++
+	if number > t.head {
+		t.head = number
+	}
+	if !t.running {
+		t.running = true
+		t.wg.Add(1)
+		go t.catchUp(ctx)
+	}
+}
+
+// Wait blocks until the catch-up in progress, if any, returns.
+func (t *Tracker) Wait() {
+	t.wg.Wait()
+}
+
+// Done records the end of the sending of head, passed to CatchUp before.
+// A head that was not delivered counts as missed by the next CatchUp.
+func (t *Tracker) Done(head *types.Header, delivered bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	number := head.Number.Uint64()
+	if t.pending[number]--; t.pending[number] <= 0 {
+		delete(t.pending, number)
+	}
+	if !delivered {
+		return nil
+	}
+	t.delivered[number] = head.Hash()
+	return t.advance()
+}
+
+// catchUp sends the missed blocks until there are none left. The lock is
+// only held between the blocks, so the heads go on meanwhile.
+func (t *Tracker) catchUp(ctx context.Context) {
+	defer t.wg.Done()
+
+	for {
+		segments, err := t.missed()
+		if err != nil {
+			log.Error("Mamoru catch-up", "err", err, "ctx", mamoru.CtxBackfill)
+			return
+		}
+		if len(segments) == 0 {
+			return
+		}
+		for _, segment := range segments {
+			if err := t.runner.run(ctx, segment[0], segment[1], t.deliver); err != nil {
+				log.Error("Mamoru catch-up", "from", segment[0], "to", segment[1], "err", err, "ctx", mamoru.CtxBackfill)
+				t.mu.Lock()
+				t.running = false
+				t.mu.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// missed returns the ranges of blocks missed before the highest head, and
+// ends the catch-up if there are none.
+func (t *Tracker) missed() ([][2]uint64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	progress, err := t.runner.checkpoint.Load()
+	if err != nil {
+		t.running = false
+		return nil, err
+	}
+	base, ok := t.base(progress)
+	if !ok || t.head <= base+1 {
+		t.running = false
+		return nil, nil
+	}
+	from, to := base+1, t.head-1
+	if to-from+1 > t.maxGap {
+		log.Warn("Mamoru catch-up gap over the cap", "from", from, "to", to, "max", t.maxGap, "ctx", mamoru.CtxBackfill)
+		t.floor = to - t.maxGap
+		from = t.floor + 1
+		if err := t.advance(); err != nil {
+			t.running = false
+			return nil, err
+		}
+	}
+
+	// The gaps around the heads in flight and the blocks delivered
+	var segments [][2]uint64
+	for start := from; start <= to; {
+		end := start
+		for end <= to && t.pending[end] == 0 {
+			if _, ok := t.delivered[end]; ok {
+				break
+			}
+			end++
+		}
+		if end > start {
+			segments = append(segments, [2]uint64{start, end - 1})
+		}
+		start = end + 1
+	}
+	if len(segments) == 0 {
+		t.running = false
+	} else {
+		log.Info("Mamoru catch-up", "from", from, "to", to, "head", t.head, "ctx", mamoru.CtxBackfill)
+	}
+	return segments, nil
+}
+
+// deliver records a block sent by the catch-up.
+func (t *Tracker) deliver(progress Progress) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.delivered[progress.Number] = progress.Hash
+	return t.advance()
+}
+
+// base returns the highest block delivered or given up on, false before the
+// first head delivered.
+func (t *Tracker) base(progress *Progress) (uint64, bool) {
+	if progress == nil {
+		return t.floor, t.floor > 0
+	}
+	if t.floor > progress.Number {
+		return t.floor, true
+	}
+	return progress.Number, true
+}
+
+// advance moves the checkpoint over the blocks delivered right after it.
+// Before the first head delivered, it starts at the lowest block delivered
+// once no head below it is in flight.
+func (t *Tracker) advance() error {
+	progress, err := t.runner.checkpoint.Load()
+	if err != nil {
+		return err
+	}
+	base, ok := t.base(progress)
+	if !ok {
+		lowest, found := uint64(0), false
+		for number := range t.delivered {
+			if !found || number < lowest {
+				lowest, found = number, true
+			}
+		}
+		if !found {
+			return nil
+		}
+		for number := range t.pending {
+			if number < lowest {
+				return nil
+			}
+		}
+		base = lowest - 1
+	}
+
+	var last *Progress
+	for {
+		hash, found := t.delivered[base+1]
+		if !found {
+			break
+		}
+		base++
+		last = &Progress{Number: base, Hash: hash}
+	}
+	for number := range t.delivered {
+		if number <= base {
+			delete(t.delivered, number)
+		}
+	}
+	if last == nil {
+		return nil
+	}
+	return t.runner.checkpoint.Save(*last)
+}
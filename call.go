@@ -1,37 +1,82 @@
 package mamoru
 
 import (
+	"errors"
 	"math/big"
 	"strings"
 	"sync/atomic"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers"
 )
 
 type CallFrame struct {
-	Type    string
-	From    string
-	To      string
-	Value   uint64
-	Gas     uint64
-	GasUsed uint64
-	Input   []byte
-	Output  string
-	Error   string
-	Depth   uint32
+	Type         string
+	From         string
+	To           string
+	Value        *big.Int
+	Gas          uint64
+	GasUsed      uint64
+	Input        []byte
+	Output       string
+	Error        string
+	Depth        uint32
+	TxIndex      uint32   // Index of the transaction within its block
+	TxHash       string   // Filled in by TakeBlockResult
+	Index        uint32   // Position of the frame within its transaction, in call order
+	ParentIndex  int      // Index of the calling frame, -1 for the top call
+	TraceAddress []uint32 // Path from the top call, as in the trace_ RPC namespace
+	Reverted     bool     // State changes of the frame were rolled back, by itself or by a caller
+	Revert       *Revert  // Decoded revert payload, if the frame reverted with one
+	Logs         []CallLog
+	Storage      []StorageAccess // Collected if CallTracerConfig.WithStorage is set
+
+	Calls []*CallFrame // Subcalls, linked by TakeResult
+
+	subcalls uint32 // Number of subcalls entered so far
+}
+
+// CallLog is an event emitted by a call frame.
+type CallLog struct {
+	Address  string
+	Topics   []common.Hash
+	Data     []byte
+	Index    uint32 // Position of the log among the logs of its frame
+	Position uint32 // Number of subcalls the frame made before emitting the log
+	Reverted bool   // The log was rolled back with its frame and is not in the receipt
+}
+
+// StorageAccess is an SLOAD or SSTORE executed by a call frame. For SLOAD,
+// Before and After are both the value loaded.
+type StorageAccess struct {
+	Address  string // Contract whose storage is accessed, differs from the frame's To in DELEGATECALL and CALLCODE
+	Op       string // "SLOAD" or "SSTORE"
+	Slot     common.Hash
+	Before   common.Hash
+	After    common.Hash
+	Index    uint32 // Position of the access among the accesses of its frame
+	Position uint32 // Number of subcalls the frame made before the access
+	Reverted bool   // The access was rolled back with its frame, for SSTORE the write has no effect
 }
 
 type CallTracer struct {
 	env       *vm.EVM
-	callstack []CallFrame
+	callstack []CallFrame // Frames of the transaction being executed, in call order
+	open      []int       // Indexes in callstack of the frames not exited yet
+	skipped   int         // Number of open scopes entered after an interruption
+	frames    []CallFrame // Frames of finished transactions, in execution order
+	gasLimit  uint64
 	config    CallTracerConfig
 	interrupt uint32 // Atomic flag to signal execution interruption
 	reason    error  // Textual reason for the interruption
 }
 
 type CallTracerConfig struct {
-	OnlyTopCall bool `json:"onlyTopCall"` // If true, call tracer won't collect any subcalls
+	OnlyTopCall   bool          `json:"onlyTopCall"` // If true, call tracer won't collect any subcalls
+	ErrorRegistry ErrorRegistry `json:"-"`           // Resolves custom errors in revert payloads, optional
+	WithStorage   bool          `json:"withStorage"` // If true, call tracer records SLOAD and SSTORE of every frame
 }
 
 var _ vm.EVMLogger = &CallTracer{}
@@ -39,44 +84,140 @@ var _ vm.EVMLogger = &CallTracer{}
 // NewCallTracer returns a native go tracer which tracks
 // call frames of a tx, and implements vm.EVMLogger.
 func NewCallTracer(OnlyTopCall bool) *CallTracer {
+	return NewCallTracerWithConfig(CallTracerConfig{OnlyTopCall: OnlyTopCall})
+}
+
+// NewCallTracerWithConfig is NewCallTracer with the full set of options.
+func NewCallTracerWithConfig(config CallTracerConfig) *CallTracer {
 	// First callframe contains tx context info
 	// and is populated on start and end.
 	return &CallTracer{
-		callstack: []CallFrame{{}},
-		config:    CallTracerConfig{OnlyTopCall: OnlyTopCall}}
+		callstack: []CallFrame{{ParentIndex: -1}},
+		config:    config}
 }
 
 // CaptureStart implements the EVMLogger interface to initialize the tracing operation.
 func (t *CallTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
 	t.env = env
 	t.callstack[0] = CallFrame{
-		Type:  "CALL",
-		From:  addrToHex(from),
-		To:    addrToHex(to),
-		Input: input,
-		Gas:   gas,
-		Value: value.Uint64(),
+		Type:        "CALL",
+		From:        addrToHex(from),
+		To:          addrToHex(to),
+		Input:       input,
+		Gas:         gas,
+		Value:       copyBig(value),
+		ParentIndex: -1,
 	}
 	if create {
 		t.callstack[0].Type = "CREATE"
 	}
+	t.open = []int{0}
 }
 
 // CaptureEnd is called after the call finishes to finalize the tracing.
 func (t *CallTracer) CaptureEnd(output []byte, gasUsed uint64, err error) {
-	t.callstack[0].GasUsed = gasUsed
+	t.callstack[0].processOutput(output, gasUsed, err, t.config.ErrorRegistry)
+}
+
+// processOutput records the result of the frame once its scope is exited.
+func (f *CallFrame) processOutput(output []byte, gasUsed uint64, err error, registry ErrorRegistry) {
+	f.GasUsed = gasUsed
 	if err != nil {
-		t.callstack[0].Error = err.Error()
-		if err.Error() == "execution reverted" && len(output) > 0 {
-			t.callstack[0].Output = bytesToHex(output)
+		f.Error = err.Error()
+		if errors.Is(err, vm.ErrExecutionReverted) && len(output) > 0 {
+			f.Output = bytesToHex(output)
+			f.Revert = DecodeRevert(output, registry)
 		}
 	} else {
-		t.callstack[0].Output = bytesToHex(output)
+		f.Output = bytesToHex(output)
 	}
 }
 
 // CaptureState implements the EVMLogger interface to trace a single step of VM execution.
 func (t *CallTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+	// skip if the previous op caused an error
+	if err != nil {
+		return
+	}
+	isLog := op >= vm.LOG0 && op <= vm.LOG4
+	isStorage := t.config.WithStorage && (op == vm.SLOAD || op == vm.SSTORE)
+	if !isLog && !isStorage {
+		return
+	}
+	// Avoid processing nested calls when only caring about top call
+	if t.config.OnlyTopCall && depth > 1 {
+		return
+	}
+	// Skip if tracing was interrupted
+	if atomic.LoadUint32(&t.interrupt) > 0 || t.skipped > 0 || len(t.open) == 0 {
+		return
+	}
+	if isLog {
+		t.captureLog(op, scope)
+	} else {
+		t.captureStorage(op, scope)
+	}
+}
+
+// captureLog attaches the log about to be emitted by op to the current frame.
+func (t *CallTracer) captureLog(op vm.OpCode, scope *vm.ScopeContext) {
+	stackData := scope.Stack.Data()
+	size := int(op - vm.LOG0)
+	if len(stackData) < 2+size {
+		return
+	}
+	// Don't modify the stack
+	mStart := stackData[len(stackData)-1]
+	mSize := stackData[len(stackData)-2]
+	if !mStart.IsUint64() || !mSize.IsUint64() {
+		return
+	}
+	topics := make([]common.Hash, size)
+	for i := 0; i < size; i++ {
+		topic := stackData[len(stackData)-2-(i+1)]
+		topics[i] = common.Hash(topic.Bytes32())
+	}
+	data, err := tracers.GetMemoryCopyPadded(scope.Memory, int64(mStart.Uint64()), int64(mSize.Uint64()))
+	if err != nil {
+		// mSize was unrealistically large
+		return
+	}
+
+	frame := &t.callstack[t.open[len(t.open)-1]]
+	frame.Logs = append(frame.Logs, CallLog{
+		Address:  addrToHex(scope.Contract.Address()),
+		Topics:   topics,
+		Data:     data,
+		Index:    uint32(len(frame.Logs)),
+		Position: frame.subcalls,
+	})
+}
+
+// captureStorage attaches the storage access about to be made by op to the
+// current frame.
+func (t *CallTracer) captureStorage(op vm.OpCode, scope *vm.ScopeContext) {
+	stackData := scope.Stack.Data()
+	if len(stackData) < 1 || (op == vm.SSTORE && len(stackData) < 2) {
+		return
+	}
+	address := scope.Contract.Address()
+	slot := common.Hash(stackData[len(stackData)-1].Bytes32())
+	before := t.env.StateDB.GetState(address, slot)
+	after := before
+	if op == vm.SSTORE {
+		after = common.Hash(stackData[len(stackData)-2].Bytes32())
+	}
+
+	frame := &t.callstack[t.open[len(t.open)-1]]
+	frame.Storage = append(frame.Storage, StorageAccess{
+		Address:  addrToHex(address),
+		Op:       op.String(),
+		Slot:     slot,
+		Before:   before,
+		After:    after,
+		Index:    uint32(len(frame.Storage)),
+		Position: frame.subcalls,
+	})
 }
 
 // CaptureFault implements the EVMLogger interface to trace an execution fault.
@@ -91,46 +232,125 @@ func (t *CallTracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.
 	// Skip if tracing was interrupted
 	if atomic.LoadUint32(&t.interrupt) > 0 {
 		t.env.Cancel()
+		t.skipped++
 		return
 	}
 
-	size := len(t.callstack)
-	var valueC uint64
-	if value != nil {
-		valueC = value.Uint64()
-	}
+	parentIndex := t.open[len(t.open)-1]
+	parent := &t.callstack[parentIndex]
+	position := parent.subcalls
+	parent.subcalls++
+	traceAddress := make([]uint32, len(parent.TraceAddress), len(parent.TraceAddress)+1)
+	copy(traceAddress, parent.TraceAddress)
+
 	call := CallFrame{
-		Type:  typ.String(),
-		From:  addrToHex(from),
-		To:    addrToHex(to),
-		Input: input,
-		Gas:   gas,
-		Depth: uint32(size),
-		Value: valueC,
+		Type:         typ.String(),
+		From:         addrToHex(from),
+		To:           addrToHex(to),
+		Input:        input,
+		Gas:          gas,
+		Depth:        parent.Depth + 1,
+		Value:        copyBig(value),
+		Index:        uint32(len(t.callstack)),
+		ParentIndex:  parentIndex,
+		TraceAddress: append(traceAddress, position),
 	}
 	t.callstack = append(t.callstack, call)
+	t.open = append(t.open, len(t.callstack)-1)
 }
 
 // CaptureExit is called when EVM exits a scope, even if the scope didn't
 // execute any code.
 func (t *CallTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+	if t.config.OnlyTopCall {
+		return
+	}
+	if t.skipped > 0 {
+		t.skipped--
+		return
+	}
+	// The top call is closed by CaptureEnd
+	if len(t.open) <= 1 {
+		return
+	}
+	index := t.open[len(t.open)-1]
+	t.open = t.open[:len(t.open)-1]
+	t.callstack[index].processOutput(output, gasUsed, err, t.config.ErrorRegistry)
 }
 
-func (*CallTracer) CaptureTxStart(uint64) {}
+// CaptureTxStart opens a new call tree, so a tracer installed for a whole
+// block keeps the frames of every transaction apart.
+func (t *CallTracer) CaptureTxStart(gasLimit uint64) {
+	t.gasLimit = gasLimit
+	t.resetTx()
+}
 
-func (*CallTracer) CaptureTxEnd(uint64) {}
+func (t *CallTracer) resetTx() {
+	t.callstack = []CallFrame{{ParentIndex: -1}}
+	t.open = nil
+	t.skipped = 0
+}
 
-// TakeResult returns the json-encoded nested list of call traces, and any
-// error arising from the encoding or forceful termination (via `Stop`).
+// CaptureTxEnd closes the call tree of the current transaction and stamps
+// its frames with the transaction index taken from the state.
+func (t *CallTracer) CaptureTxEnd(restGas uint64) {
+	// The transaction failed before any call was made, e.g. on intrinsic gas
+	if t.callstack[0].Type == "" {
+		t.resetTx()
+		return
+	}
+	t.callstack[0].GasUsed = t.gasLimit - restGas
+	t.commitTx()
+}
+
+// commitTx moves the frames of the current transaction to the result.
+func (t *CallTracer) commitTx() {
+	var txIndex uint32
+	if txState, ok := t.env.StateDB.(interface{ TxIndex() int }); ok {
+		txIndex = uint32(txState.TxIndex())
+	}
+	for i := range t.callstack {
+		frame := &t.callstack[i]
+		frame.TxIndex = txIndex
+		// Callers precede their subcalls, so the parent is already settled
+		frame.Reverted = frame.Error != "" ||
+			(frame.ParentIndex >= 0 && t.callstack[frame.ParentIndex].Reverted)
+		for j := range frame.Logs {
+			frame.Logs[j].Reverted = frame.Reverted
+		}
+		for j := range frame.Storage {
+			frame.Storage[j].Reverted = frame.Reverted
+		}
+	}
+	t.frames = append(t.frames, t.callstack...)
+	t.resetTx()
+}
+
+// TakeResult returns the flat list of call frames of all transactions traced
+// since the last call, and any error arising from forceful termination (via
+// `Stop`). The frames are linked to their subcalls through Calls, so
+// NestCallFrames gives the nested view of the same result.
 func (t *CallTracer) TakeResult() ([]*CallFrame, error) {
+	// The EVM was driven without the transaction hooks
+	if t.callstack[0].Type != "" {
+		t.commitTx()
+	}
 	var frames []*CallFrame
-	for _, call := range t.callstack {
+	var txStart int
+	for i, call := range t.frames {
 		rcall := call
+		if rcall.ParentIndex < 0 {
+			txStart = i
+		} else {
+			parent := frames[txStart+rcall.ParentIndex]
+			parent.Calls = append(parent.Calls, &rcall)
+		}
 		frames = append(frames, &rcall)
 	}
 
 	defer func() {
-		t.callstack = []CallFrame{{}}
+		t.resetTx()
+		t.frames = nil
 		atomic.StoreUint32(&t.interrupt, 0)
 		t.reason = nil
 	}()
@@ -138,12 +358,45 @@ func (t *CallTracer) TakeResult() ([]*CallFrame, error) {
 	return frames, t.reason
 }
 
+// TakeBlockResult is TakeResult for a tracer that executed txs, or a part of
+// them, against a state whose transaction index follows txs. It sets the hash
+// of the transaction on every frame.
+func (t *CallTracer) TakeBlockResult(txs types.Transactions) ([]*CallFrame, error) {
+	frames, err := t.TakeResult()
+	for _, frame := range frames {
+		if int(frame.TxIndex) < len(txs) {
+			frame.TxHash = txs[frame.TxIndex].Hash().String()
+		}
+	}
+
+	return frames, err
+}
+
 // Stop terminates execution of the tracer at the first opportune moment.
 func (t *CallTracer) Stop(err error) {
 	t.reason = err
 	atomic.StoreUint32(&t.interrupt, 1)
 }
 
+// NestCallFrames returns the top calls of a result of TakeResult, each one
+// the root of its transaction's call tree.
+func NestCallFrames(frames []*CallFrame) []*CallFrame {
+	var roots []*CallFrame
+	for _, frame := range frames {
+		if frame.ParentIndex < 0 {
+			roots = append(roots, frame)
+		}
+	}
+	return roots
+}
+
+func copyBig(x *big.Int) *big.Int {
+	if x == nil {
+		return nil
+	}
+	return new(big.Int).Set(x)
+}
+
 func bytesToHex(s []byte) string {
 	return "0x" + common.Bytes2Hex(s)
 }
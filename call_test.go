@@ -0,0 +1,325 @@
+package mamoru
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testChainContext struct{}
+
+func (testChainContext) Engine() consensus.Engine { return ethash.NewFaker() }
+
+func (testChainContext) GetHeader(common.Hash, uint64) *types.Header { return nil }
+
+// callEnv executes transactions of a funded account on an in-memory state,
+// the way the state processor does for a block.
+type callEnv struct {
+	t       *testing.T
+	statedb *state.StateDB
+	header  *types.Header
+	signer  types.Signer
+	key     *ecdsa.PrivateKey
+	nonce   uint64
+	gasUsed uint64
+	gasPool *core.GasPool
+}
+
+func newCallEnv(t *testing.T) *callEnv {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	key, _ := crypto.GenerateKey()
+	statedb.SetBalance(crypto.PubkeyToAddress(key.PublicKey), new(big.Int).Mul(big.NewInt(1000), big.NewInt(params.Ether)))
+	header := &types.Header{
+		Number:     big.NewInt(1),
+		GasLimit:   30_000_000,
+		Difficulty: big.NewInt(1),
+		BaseFee:    big.NewInt(params.InitialBaseFee),
+	}
+	return &callEnv{
+		t:       t,
+		statedb: statedb,
+		header:  header,
+		signer:  types.LatestSigner(params.TestChainConfig),
+		key:     key,
+		gasPool: new(core.GasPool).AddGas(header.GasLimit),
+	}
+}
+
+func (e *callEnv) sender() common.Address {
+	return crypto.PubkeyToAddress(e.key.PublicKey)
+}
+
+func (e *callEnv) tx(to *common.Address, value *big.Int, data []byte) *types.Transaction {
+	tx := types.MustSignNewTx(e.key, e.signer, &types.DynamicFeeTx{
+		ChainID:   params.TestChainConfig.ChainID,
+		Nonce:     e.nonce,
+		Gas:       1_000_000,
+		GasFeeCap: big.NewInt(2 * params.InitialBaseFee),
+		GasTipCap: big.NewInt(1),
+		To:        to,
+		Value:     value,
+		Data:      data,
+	})
+	e.nonce++
+	return tx
+}
+
+// apply executes txs with tracer installed, continuing the block.
+func (e *callEnv) apply(tracer vm.EVMLogger, txs types.Transactions) types.Receipts {
+	var receipts types.Receipts
+	for i, tx := range txs {
+		e.statedb.SetTxContext(tx.Hash(), i)
+		receipt, err := core.ApplyTransaction(params.TestChainConfig, testChainContext{}, &common.Address{}, e.gasPool,
+			e.statedb, e.header, tx, &e.gasUsed, vm.Config{Tracer: tracer})
+		require.NoError(e.t, err)
+		receipts = append(receipts, receipt)
+	}
+	return receipts
+}
+
+func TestCallTracer_PerTransaction(t *testing.T) {
+	env := newCallEnv(t)
+	to := common.HexToAddress("0xdead")
+	txs := types.Transactions{
+		env.tx(&to, big.NewInt(1), nil),
+		env.tx(&to, big.NewInt(2), nil),
+		env.tx(&to, big.NewInt(3), nil),
+	}
+
+	// A single tracer installed for the whole block, as in full-sync mode
+	tracer := NewCallTracer(false)
+	receipts := env.apply(tracer, txs)
+
+	frames, err := tracer.TakeBlockResult(txs)
+	require.NoError(t, err)
+	require.Len(t, frames, len(txs))
+	for i, frame := range frames {
+		assert.Equal(t, uint32(i), frame.TxIndex)
+		assert.Equal(t, txs[i].Hash().String(), frame.TxHash)
+		assert.Equal(t, int64(i+1), frame.Value.Int64())
+		assert.Equal(t, receipts[i].GasUsed, frame.GasUsed)
+		assert.Equal(t, addrToHex(env.sender()), frame.From)
+	}
+
+	traces := NewFeed(params.TestChainConfig).FeedCallTraces(frames, 1)
+	for i, trace := range traces {
+		assert.Equal(t, uint32(i), trace.TxIndex)
+		assert.Equal(t, uint32(0), trace.Seq)
+		assert.Equal(t, txs[i].Hash().String(), trace.TxHash)
+	}
+
+	// The result is drained
+	frames, err = tracer.TakeResult()
+	assert.NoError(t, err)
+	assert.Empty(t, frames)
+}
+
+// callCode returns code that calls each of targets with all gas and no
+// arguments, then stops or, if revert is set, reverts.
+func callCode(revert bool, targets ...common.Address) []byte {
+	var code []byte
+	for _, target := range targets {
+		// retSize, retOffset, argsSize, argsOffset, value
+		code = append(code, 0x60, 0, 0x60, 0, 0x60, 0, 0x60, 0, 0x60, 0)
+		code = append(code, byte(vm.PUSH20))
+		code = append(code, target.Bytes()...)
+		code = append(code, byte(vm.GAS), byte(vm.CALL), byte(vm.POP))
+	}
+	if revert {
+		return append(code, 0x60, 0, 0x60, 0, byte(vm.REVERT))
+	}
+	return append(code, byte(vm.STOP))
+}
+
+func TestCallTracer_CallTree(t *testing.T) {
+	env := newCallEnv(t)
+	var (
+		reverter = common.HexToAddress("0xc0")
+		middle   = common.HexToAddress("0xb0")
+		top      = common.HexToAddress("0xa0")
+		topRev   = common.HexToAddress("0xa1")
+	)
+	env.statedb.SetCode(reverter, callCode(true))
+	env.statedb.SetCode(middle, callCode(false, reverter))
+	env.statedb.SetCode(top, callCode(false, middle, reverter))
+	env.statedb.SetCode(topRev, callCode(true, middle))
+
+	txs := types.Transactions{env.tx(&top, nil, nil), env.tx(&topRev, nil, nil)}
+	tracer := NewCallTracer(false)
+	env.apply(tracer, txs)
+
+	frames, err := tracer.TakeBlockResult(txs)
+	require.NoError(t, err)
+	require.Len(t, frames, 7)
+
+	// top -> middle -> reverter, top -> reverter
+	tx0 := frames[:4]
+	assert.Equal(t, []int{-1, 0, 1, 0}, []int{tx0[0].ParentIndex, tx0[1].ParentIndex, tx0[2].ParentIndex, tx0[3].ParentIndex})
+	assert.Equal(t, [][]uint32{nil, {0}, {0, 0}, {1}}, [][]uint32{tx0[0].TraceAddress, tx0[1].TraceAddress, tx0[2].TraceAddress, tx0[3].TraceAddress})
+	assert.Equal(t, []uint32{0, 1, 2, 1}, []uint32{tx0[0].Depth, tx0[1].Depth, tx0[2].Depth, tx0[3].Depth})
+	assert.Equal(t, []bool{false, false, true, true}, []bool{tx0[0].Reverted, tx0[1].Reverted, tx0[2].Reverted, tx0[3].Reverted})
+	assert.Equal(t, vm.ErrExecutionReverted.Error(), tx0[2].Error)
+	assert.Empty(t, tx0[1].Error)
+	assert.Equal(t, "0x", tx0[1].Output)
+	assert.NotZero(t, tx0[1].GasUsed)
+	assert.Equal(t, []*CallFrame{tx0[1], tx0[3]}, tx0[0].Calls)
+	assert.Equal(t, []*CallFrame{tx0[2]}, tx0[1].Calls)
+
+	// topRev -> middle -> reverter, all rolled back by the top call
+	tx1 := frames[4:]
+	assert.Equal(t, uint32(1), tx1[0].TxIndex)
+	assert.NotEmpty(t, tx1[0].Error)
+	assert.Empty(t, tx1[1].Error)
+	assert.True(t, tx1[1].Reverted)
+	assert.True(t, tx1[2].Reverted)
+
+	roots := NestCallFrames(frames)
+	assert.Equal(t, []*CallFrame{frames[0], frames[4]}, roots)
+
+	traces := NewFeed(params.TestChainConfig).FeedCallTraces(frames, 1)
+	assert.Equal(t, uint32(2), traces[2].Seq)
+	assert.Equal(t, 1, traces[2].ParentSeq)
+	assert.Equal(t, uint32(2), traces[2].Depth)
+	assert.True(t, traces[2].Reverted)
+	assert.Equal(t, uint32(0), traces[4].Seq)
+	assert.Equal(t, uint32(1), traces[4].TxIndex)
+}
+
+func TestCallTracer_OnlyTopCall(t *testing.T) {
+	env := newCallEnv(t)
+	reverter, top := common.HexToAddress("0xc0"), common.HexToAddress("0xa0")
+	env.statedb.SetCode(reverter, callCode(true))
+	env.statedb.SetCode(top, callCode(false, reverter))
+
+	txs := types.Transactions{env.tx(&top, nil, nil)}
+	tracer := NewCallTracer(true)
+	env.apply(tracer, txs)
+
+	frames, err := tracer.TakeBlockResult(txs)
+	require.NoError(t, err)
+	require.Len(t, frames, 1)
+	assert.Empty(t, frames[0].Calls)
+	assert.False(t, frames[0].Reverted)
+}
+
+// logCode returns code that emits an empty LOG1 with topic.
+func logCode(topic byte) []byte {
+	return []byte{byte(vm.PUSH1), topic, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG1)}
+}
+
+func TestCallTracer_Logs(t *testing.T) {
+	env := newCallEnv(t)
+	reverter, top := common.HexToAddress("0xc0"), common.HexToAddress("0xa0")
+	env.statedb.SetCode(reverter, append(logCode(2), callCode(true)...))
+	code := logCode(1)
+	code = append(code, callCode(false, reverter)...)
+	code = append(code[:len(code)-1], logCode(3)...) // drop STOP
+	env.statedb.SetCode(top, code)
+
+	txs := types.Transactions{env.tx(&top, nil, nil)}
+	tracer := NewCallTracer(false)
+	receipts := env.apply(tracer, txs)
+	require.Len(t, receipts[0].Logs, 2)
+
+	frames, err := tracer.TakeBlockResult(txs)
+	require.NoError(t, err)
+	require.Len(t, frames, 2)
+
+	topLogs := frames[0].Logs
+	require.Len(t, topLogs, 2)
+	assert.Equal(t, addrToHex(top), topLogs[0].Address)
+	assert.Equal(t, []common.Hash{common.BytesToHash([]byte{1})}, topLogs[0].Topics)
+	assert.Equal(t, []uint32{0, 1}, []uint32{topLogs[0].Index, topLogs[1].Index})
+	assert.Equal(t, []uint32{0, 1}, []uint32{topLogs[0].Position, topLogs[1].Position})
+	assert.False(t, topLogs[0].Reverted)
+	assert.False(t, topLogs[1].Reverted)
+
+	innerLogs := frames[1].Logs
+	require.Len(t, innerLogs, 1)
+	assert.Equal(t, addrToHex(reverter), innerLogs[0].Address)
+	assert.True(t, innerLogs[0].Reverted)
+
+	traces := NewFeed(params.TestChainConfig).FeedCallTraces(frames, 1)
+	assert.Len(t, traces[0].Logs, 2)
+	assert.True(t, traces[1].Logs[0].Reverted)
+}
+
+func TestCallTracer_Storage(t *testing.T) {
+	env := newCallEnv(t)
+	var (
+		impl  = common.HexToAddress("0xb0")
+		proxy = common.HexToAddress("0xa0")
+		slot  = common.BigToHash(big.NewInt(1))
+	)
+	// sload(1), sstore(1, 42)
+	env.statedb.SetCode(impl, []byte{
+		byte(vm.PUSH1), 1, byte(vm.SLOAD), byte(vm.POP),
+		byte(vm.PUSH1), 42, byte(vm.PUSH1), 1, byte(vm.SSTORE), byte(vm.STOP),
+	})
+	// delegatecall(gas, impl, 0, 0, 0, 0)
+	code := []byte{0x60, 0, 0x60, 0, 0x60, 0, 0x60, 0, byte(vm.PUSH20)}
+	code = append(code, impl.Bytes()...)
+	env.statedb.SetCode(proxy, append(code, byte(vm.GAS), byte(vm.DELEGATECALL), byte(vm.STOP)))
+	env.statedb.SetState(proxy, slot, common.BigToHash(big.NewInt(7)))
+
+	txs := types.Transactions{env.tx(&proxy, nil, nil)}
+	tracer := NewCallTracerWithConfig(CallTracerConfig{WithStorage: true})
+	env.apply(tracer, txs)
+
+	frames, err := tracer.TakeBlockResult(txs)
+	require.NoError(t, err)
+	require.Len(t, frames, 2)
+	assert.Empty(t, frames[0].Storage)
+
+	// The implementation runs on the storage of the proxy
+	accesses := frames[1].Storage
+	require.Len(t, accesses, 2)
+	assert.Equal(t, StorageAccess{
+		Address: addrToHex(proxy),
+		Op:      "SLOAD",
+		Slot:    slot,
+		Before:  common.BigToHash(big.NewInt(7)),
+		After:   common.BigToHash(big.NewInt(7)),
+	}, accesses[0])
+	assert.Equal(t, StorageAccess{
+		Address: addrToHex(proxy),
+		Op:      "SSTORE",
+		Slot:    slot,
+		Before:  common.BigToHash(big.NewInt(7)),
+		After:   common.BigToHash(big.NewInt(42)),
+		Index:   1,
+	}, accesses[1])
+
+	traces := NewFeed(params.TestChainConfig).FeedCallTraces(frames, 1)
+	assert.Equal(t, accesses, traces[1].Storage)
+
+	// A write rolled back by a revert
+	reverter := common.HexToAddress("0xc0")
+	env.statedb.SetCode(reverter, append([]byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 1, byte(vm.SSTORE)}, callCode(true)...))
+	txs = types.Transactions{env.tx(&reverter, nil, nil)}
+	env.apply(tracer, txs)
+	frames, err = tracer.TakeBlockResult(txs)
+	require.NoError(t, err)
+	require.Len(t, frames[0].Storage, 1)
+	assert.True(t, frames[0].Storage[0].Reverted)
+
+	// Off by default
+	tracer = NewCallTracer(false)
+	env.apply(tracer, types.Transactions{env.tx(&impl, nil, nil)})
+	frames, err = tracer.TakeResult()
+	require.NoError(t, err)
+	assert.Empty(t, frames[0].Storage)
+}
@@ -0,0 +1,166 @@
+package call_tracer
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	mamoru "github.com/Mamoru-Foundation/geth-mamoru-core-sdk"
+)
+
+// DefaultCacheSize is the number of blocks a Cache made with a size of zero
+// holds.
+const DefaultCacheSize = 64
+
+// SharedCache is a Cache meant to be shared by every pipeline of a node, e.g.
+// the light chain and the light txpool, which trace the same blocks.
+var SharedCache = NewCache(DefaultCacheSize)
+
+// errTraceAborted is the error of an entry whose trace panicked.
+var errTraceAborted = errors.New("trace aborted")
+
+// Cache shares the trace results of blocks between the TraceBlock calls
+// using it through Options, so a block is traced once. A call on a block
+// being traced waits for the first one. Results are only shared between
+// calls of the same storage, verification, error handling and timeout
+// settings, and a block that failed to be traced is traced again.
+//
+// Only the call tracing a block advances its state to the post-block state,
+// the calls sharing the results leave theirs untouched: a caller needing the
+// post-block state must not use a Cache.
+type Cache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[cacheKey]*cacheEntry
+	order   []cacheKey // Oldest first
+}
+
+type cacheKey struct {
+	hash            common.Hash
+	withStorage     bool
+	verify          bool
+	continueOnError bool
+	txTimeout       time.Duration
+	blockDeadline   time.Duration
+	errorRegistry   mamoru.ErrorRegistry
+}
+
+type cacheEntry struct {
+	done       chan struct{}
+	results    []*TxTraceResult
+	divergence *Divergence
+	err        error
+}
+
+// NewCache returns a Cache holding the last size blocks traced, or
+// DefaultCacheSize if size is not positive.
+func NewCache(size int) *Cache {
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+	return &Cache{size: size, entries: make(map[cacheKey]*cacheEntry)}
+}
+
+// Len returns the number of blocks held.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// trace returns the cached results of block, or traces it with trace. The
+// divergence found by the first trace is reported again to the
+// Options.OnDivergence of every call sharing it. A config with an error
+// registry that can't be told apart from others, as its type is not
+// comparable, is traced without the cache.
+func (c *Cache) trace(ctx context.Context, config *Config, block *types.Block,
+	trace func(*Config) ([]*TxTraceResult, error),
+) ([]*TxTraceResult, error) {
+	if config.errorRegistry != nil && !reflect.TypeOf(config.errorRegistry).Comparable() {
+		return trace(config)
+	}
+	key := cacheKey{
+		hash:            block.Hash(),
+		withStorage:     config.withStorage,
+		verify:          config.options.OnDivergence != nil,
+		continueOnError: config.options.ContinueOnError,
+		txTimeout:       config.options.txTimeout(),
+		blockDeadline:   config.options.BlockDeadline,
+		errorRegistry:   config.errorRegistry,
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &cacheEntry{done: make(chan struct{})}
+		c.add(key, entry)
+	}
+	c.mu.Unlock()
+
+	if ok {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-entry.done:
+		}
+		if entry.err != nil {
+			return trace(config)
+		}
+		if entry.divergence != nil {
+			config.options.OnDivergence(entry.divergence)
+		}
+		return entry.results, nil
+	}
+
+	traced := *config
+	if onDivergence := config.options.OnDivergence; onDivergence != nil {
+		traced.options.OnDivergence = func(divergence *Divergence) {
+			entry.divergence = divergence
+			onDivergence(divergence)
+		}
+	}
+	// The calls waiting are released even if trace panics, to trace the
+	// block themselves
+	entry.err = errTraceAborted
+	defer func() {
+		if entry.err != nil {
+			c.remove(key, entry)
+		}
+		close(entry.done)
+	}()
+	entry.results, entry.err = trace(&traced)
+
+	return entry.results, entry.err
+}
+
+// add inserts entry, evicting the oldest ones past the size. Called with
+// the lock held.
+func (c *Cache) add(key cacheKey, entry *cacheEntry) {
+	c.entries[key] = entry
+	c.order = append(c.order, key)
+	for len(c.order) > c.size {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+// remove drops entry, unless it was evicted and replaced already.
+func (c *Cache) remove(key cacheKey, entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries[key] != entry {
+		return
+	}
+	delete(c.entries, key)
+	for i, k := range c.order {
+		if k == key {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+}
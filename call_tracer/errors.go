@@ -0,0 +1,95 @@
+package call_tracer
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+)
+
+// TxTraceErrorKind classifies why a transaction could not be traced.
+type TxTraceErrorKind string
+
+const (
+	// ErrKindConsensus is a transaction the replayed state rejects although
+	// the chain accepted it, e.g. on its nonce or the sender balance.
+	ErrKindConsensus TxTraceErrorKind = "consensus_mismatch"
+	// ErrKindIntrinsicGas is a transaction whose gas limit does not cover
+	// its intrinsic gas.
+	ErrKindIntrinsicGas TxTraceErrorKind = "intrinsic_gas"
+	// ErrKindMissingState is a transaction that read state the StateDB
+	// could not load, e.g. a trie node an ODR backend failed to retrieve.
+	ErrKindMissingState TxTraceErrorKind = "missing_state"
+	// ErrKindTimeout is a transaction whose tracing ran out of its timeout or
+	// of the block deadline. It was executed untraced.
+	ErrKindTimeout TxTraceErrorKind = "timeout"
+	// ErrKindInvalidTx is a transaction that cannot be turned into a
+	// message, e.g. on an invalid signature.
+	ErrKindInvalidTx TxTraceErrorKind = "invalid_tx"
+	// ErrKindExecution is any other failure.
+	ErrKindExecution TxTraceErrorKind = "execution"
+)
+
+var (
+	errTxTimeout     = errors.New("execution timeout")
+	errBlockDeadline = errors.New("block deadline exceeded")
+)
+
+// TxTraceError is the failure of a single transaction of a traced block.
+type TxTraceError struct {
+	Kind    TxTraceErrorKind `json:"kind"`
+	TxIndex int              `json:"txIndex"`
+	TxHash  common.Hash      `json:"txHash"`
+	Message string           `json:"message"`
+
+	err error
+}
+
+func newTxTraceError(kind TxTraceErrorKind, txIndex int, txHash common.Hash, err error) *TxTraceError {
+	return &TxTraceError{Kind: kind, TxIndex: txIndex, TxHash: txHash, Message: err.Error(), err: err}
+}
+
+func (e *TxTraceError) Error() string {
+	return fmt.Sprintf("tx %d (%s): %s: %s", e.TxIndex, e.TxHash, e.Kind, e.Message)
+}
+
+func (e *TxTraceError) Unwrap() error {
+	return e.err
+}
+
+// messageErrorKind classifies an error of core.ApplyMessage.
+func messageErrorKind(err error) TxTraceErrorKind {
+	switch {
+	case errors.Is(err, core.ErrIntrinsicGas):
+		return ErrKindIntrinsicGas
+	case errors.Is(err, core.ErrNonceTooLow), errors.Is(err, core.ErrNonceTooHigh), errors.Is(err, core.ErrNonceMax),
+		errors.Is(err, core.ErrInsufficientFunds), errors.Is(err, core.ErrInsufficientFundsForTransfer),
+		errors.Is(err, core.ErrGasLimitReached), errors.Is(err, core.ErrSenderNoEOA),
+		errors.Is(err, core.ErrFeeCapTooLow), errors.Is(err, core.ErrTipAboveFeeCap),
+		errors.Is(err, core.ErrFeeCapVeryHigh), errors.Is(err, core.ErrTipVeryHigh):
+		return ErrKindConsensus
+	default:
+		return ErrKindExecution
+	}
+}
+
+// tracerErrorKind classifies the reason a tracer was stopped with.
+func tracerErrorKind(err error) TxTraceErrorKind {
+	if errors.Is(err, errTxTimeout) || errors.Is(err, errBlockDeadline) {
+		return ErrKindTimeout
+	}
+	return ErrKindExecution
+}
+
+// TraceErrors returns the errors of the transactions in results that could
+// not be traced. A block with any is incomplete.
+func TraceErrors(results []*TxTraceResult) []*TxTraceError {
+	var errs []*TxTraceError
+	for _, result := range results {
+		if result != nil && result.Error != nil {
+			errs = append(errs, result.Error)
+		}
+	}
+	return errs
+}
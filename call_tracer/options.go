@@ -0,0 +1,90 @@
+package call_tracer
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/panjf2000/ants/v2"
+)
+
+const defaultTxTimeout = 15 * time.Second
+
+// Options tune TraceBlock. The zero value gives the defaults.
+type Options struct {
+	TxTimeout     time.Duration // Tracing budget of a single transaction, 15s by default
+	BlockDeadline time.Duration // Tracing budget of a whole block, unlimited by default
+	Pool          *Pool         // Pool shared across blocks, see NewPool for its size; traced inline if nil
+	Cache         *Cache        // Cache shared across pipelines, so a block is traced once, see Cache for the state
+
+	// ContinueOnError skips the transactions the replayed state rejects
+	// instead of failing the block, see TraceBlock.
+	ContinueOnError bool
+
+	// OnDivergence, if set, enables the check of the replayed post-block
+	// state root, gas used and receipt root against the block header, and is
+	// called on a mismatch.
+	OnDivergence func(*Divergence)
+}
+
+func (o Options) txTimeout() time.Duration {
+	if o.TxTimeout <= 0 {
+		return defaultTxTimeout
+	}
+	return o.TxTimeout
+}
+
+// Pool runs TraceBlock calls on a bounded set of goroutines. It is meant to
+// be created once, shared across blocks through Options, and closed when the
+// tracing stops.
+type Pool struct {
+	pool *ants.Pool
+}
+
+// NewPool returns a pool tracing at most workers blocks at once, or
+// runtime.NumCPU() if workers is not positive. Submitting to a full pool
+// blocks until a worker is free.
+func NewPool(workers int) (*Pool, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	pool, err := ants.NewPool(workers, ants.WithExpiryDuration(10*time.Second))
+	if err != nil {
+		return nil, err
+	}
+	return &Pool{pool: pool}, nil
+}
+
+// Tune changes the number of workers of the pool, runtime.NumCPU() if
+// workers is not positive. The blocks being traced are not interrupted.
+func (p *Pool) Tune(workers int) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if p.pool.Cap() != workers {
+		p.pool.Tune(workers)
+	}
+}
+
+// Workers returns the number of workers of the pool.
+func (p *Pool) Workers() int {
+	return p.pool.Cap()
+}
+
+// Close releases the workers of the pool. TraceBlock calls using the pool
+// afterwards fail.
+func (p *Pool) Close() {
+	p.pool.Release()
+}
+
+// run executes job on a worker and waits for it to finish.
+func (p *Pool) run(job func()) error {
+	done := make(chan struct{})
+	if err := p.pool.Submit(func() {
+		defer close(done)
+		job()
+	}); err != nil {
+		return err
+	}
+	<-done
+	return nil
+}
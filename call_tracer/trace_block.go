@@ -3,10 +3,7 @@ package call_tracer
 import (
 	"context"
 	"errors"
-	"fmt"
 	"math/big"
-	"runtime"
-	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -17,16 +14,19 @@ import (
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/eth/tracers"
 	"github.com/ethereum/go-ethereum/params"
-	"github.com/panjf2000/ants/v2"
 
 	mamoru "github.com/Mamoru-Foundation/geth-mamoru-core-sdk"
 )
 
 type Config struct {
-	stateDB      *state.StateDB
-	chainConfig  *params.ChainConfig
-	chainContext core.ChainContext
-	engin        consensus.Engine
+	stateDB       *state.StateDB
+	chainConfig   *params.ChainConfig
+	chainContext  core.ChainContext
+	engin         consensus.Engine
+	errorRegistry mamoru.ErrorRegistry
+	withStorage   bool
+	options       Options
+	receipts      types.Receipts
 }
 
 func NewTracerConfig(stateDB *state.StateDB, chainConfig *params.ChainConfig, chainContext core.ChainContext) *Config {
@@ -42,19 +42,69 @@ func (c *Config) GetChainConfig() *params.ChainConfig {
 	return c.chainConfig
 }
 
-// txTraceTask represents a single transaction trace task when an entire block
-// is being traced.
-type txTraceTask struct {
-	statedb *state.StateDB // Intermediate state prepped for tracing
-	index   int            // Transaction offset in the block
+// WithErrorRegistry sets the registry custom errors in revert payloads are
+// decoded with.
+func (c *Config) WithErrorRegistry(registry mamoru.ErrorRegistry) *Config {
+	c.errorRegistry = registry
+	return c
+}
+
+// WithStorage makes the call frames record their SLOAD and SSTORE.
+func (c *Config) WithStorage(enabled bool) *Config {
+	c.withStorage = enabled
+	return c
+}
+
+// WithOptions sets the timeouts and the worker pool of TraceBlock.
+func (c *Config) WithOptions(opts Options) *Config {
+	c.options = opts
+	return c
+}
+
+// WithReceipts sets the canonical receipts of the traced block. With
+// Options.OnDivergence set, they pinpoint the first diverging transaction.
+func (c *Config) WithReceipts(receipts types.Receipts) *Config {
+	c.receipts = receipts
+	return c
+}
+
+// run executes job on the pool of the options, or inline if there is none.
+func (c *Config) run(job func()) error {
+	if c.options.Pool == nil {
+		job()
+		return nil
+	}
+	return c.options.Pool.run(job)
+}
+
+func (c *Config) callTracerConfig() mamoru.CallTracerConfig {
+	return mamoru.CallTracerConfig{ErrorRegistry: c.errorRegistry, WithStorage: c.withStorage}
 }
 
 // TxTraceResult is the result of a single transaction trace.
 type TxTraceResult struct {
-	Result []*mamoru.CallFrame `json:"result,omitempty"` // Trace results produced by the tracer
-	Error  string              `json:"error,omitempty"`  // Trace failure produced by the tracer
+	Result    []*mamoru.CallFrame `json:"result,omitempty"`    // Trace results produced by the tracer
+	StateDiff *mamoru.TxStateDiff `json:"stateDiff,omitempty"` // State changed by the transaction
+	Error     *TxTraceError       `json:"error,omitempty"`     // Why the transaction could not be traced
+
+	execution *core.ExecutionResult // Result of the message, nil if it was not executed
 }
 
+// TraceBlock executes the transactions of block on top of the state of the
+// config, each one once with the tracers attached, leaving the state at the
+// post-block state. A transaction whose tracing was interrupted, by its
+// timeout or by the block deadline, is executed again without tracers, so its
+// result carries the error and the state stays correct.
+//
+// A transaction the replayed state rejects fails the whole block, unless
+// Options.ContinueOnError is set. Then it is skipped, its result carries the
+// error and the other transactions are still traced, see TraceErrors. Either
+// way per-transaction failures are *TxTraceError.
+//
+// The block is traced on the pool of the config options, or on the calling
+// goroutine if there is none. With a Cache in the options, the results of
+// a block traced already are returned as is, and the state is left
+// untouched.
 func TraceBlock(ctx context.Context,
 	config *Config,
 	block *types.Block,
@@ -62,128 +112,225 @@ func TraceBlock(ctx context.Context,
 	if block.NumberU64() == 0 {
 		return nil, errors.New("genesis is not traceable")
 	}
-	// Execute all the transaction contained within the block concurrently
+	if cache := config.options.Cache; cache != nil {
+		return cache.trace(ctx, config, block, func(config *Config) ([]*TxTraceResult, error) {
+			return runTraceBlock(ctx, config, block)
+		})
+	}
+	return runTraceBlock(ctx, config, block)
+}
+
+func runTraceBlock(ctx context.Context, config *Config, block *types.Block) ([]*TxTraceResult, error) {
 	var (
-		signer  = types.MakeSigner(config.chainConfig, block.Number(), block.Time())
-		txs     = block.Transactions()
-		results = make([]*TxTraceResult, len(txs))
-		stateDB = config.stateDB
+		results []*TxTraceResult
+		err     error
+	)
+	if poolErr := config.run(func() {
+		results, err = traceBlock(ctx, config, block)
+	}); poolErr != nil {
+		return nil, poolErr
+	}
+
+	return results, err
+}
 
-		pend = new(sync.WaitGroup)
-		jobs = make(chan *txTraceTask, len(txs))
+func traceBlock(ctx context.Context, config *Config, block *types.Block) ([]*TxTraceResult, error) {
+	traceCtx := ctx
+	if config.options.BlockDeadline > 0 {
+		var cancel context.CancelFunc
+		traceCtx, cancel = context.WithTimeout(ctx, config.options.BlockDeadline)
+		defer cancel()
+	}
+	var (
+		signer   = types.MakeSigner(config.chainConfig, block.Number(), block.Time())
+		txs      = block.Transactions()
+		results  = make([]*TxTraceResult, len(txs))
+		stateDB  = config.stateDB
+		blockCtx = core.NewEVMBlockContext(block.Header(), config.chainContext, nil)
+		verifier *blockVerifier
 	)
-	threads := runtime.NumCPU()
-	if threads > len(txs) {
-		threads = len(txs)
-	}
-	blockHash := block.Hash()
-	var defaultPool, _ = ants.NewPool(ants.DefaultAntsPoolSize, ants.WithExpiryDuration(10*time.Second))
-	//defer defaultPool.Release()
-	for th := 0; th < threads; th++ {
-		pend.Add(1)
-		_ = defaultPool.Submit(func() {
-			blockCtx := core.NewEVMBlockContext(block.Header(), config.chainContext, nil)
-			defer pend.Done()
-			// Fetch and execute the next transaction trace tasks
-			for task := range jobs {
-				msg, _ := core.TransactionToMessage(txs[task.index], signer, block.BaseFee())
-
-				txctx := &tracers.Context{
-					BlockHash: blockHash,
-					TxIndex:   task.index,
-					TxHash:    txs[task.index].Hash(),
-				}
-				res, err := traceTx(ctx, config.chainConfig, msg, txctx, blockCtx, task.statedb, config.engin)
-				if err != nil {
-					results[task.index] = &TxTraceResult{Error: err.Error()}
-					continue
-				}
-				results[task.index] = &TxTraceResult{Result: res}
-			}
-		})
+	if config.options.OnDivergence != nil {
+		verifier = &blockVerifier{config: config, block: block}
 	}
-	// EthFeed the transactions into the tracers and return
-	var failed error
-	blockCtx := core.NewEVMBlockContext(block.Header(), config.chainContext, nil)
 	for i, tx := range txs {
-		// Send the trace task over for execution
-		jobs <- &txTraceTask{statedb: stateDB.Copy(), index: i}
-
-		// Generate the next state snapshot fast without tracing
-		msg, _ := core.TransactionToMessage(tx, signer, block.BaseFee())
-		if posa, ok := config.engin.(PoSA); ok {
-			if isSystem, _ := posa.IsSystemTransaction(tx, block.Header()); isSystem {
-				balance := stateDB.GetBalance(SystemAddress)
-				if balance.Cmp(common.Big0) > 0 {
-					stateDB.SetBalance(SystemAddress, big.NewInt(0))
-					stateDB.AddBalance(block.Header().Coinbase, balance)
-				}
+		// The state is left half way through the block
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		msg, err := core.TransactionToMessage(tx, signer, block.BaseFee())
+		if err != nil {
+			txErr := newTxTraceError(ErrKindInvalidTx, i, tx.Hash(), err)
+			if !config.options.ContinueOnError {
+				return nil, txErr
 			}
+			results[i] = &TxTraceResult{Error: txErr}
+			continue
+		}
+		prepareSystemTx(config.engin, stateDB, tx, block.Header())
+		txctx := &tracers.Context{
+			BlockHash: block.Hash(),
+			TxIndex:   i,
+			TxHash:    tx.Hash(),
 		}
-		stateDB.SetTxContext(tx.Hash(), i)
-		vmenv := vm.NewEVM(blockCtx, core.NewEVMTxContext(msg), stateDB, config.chainConfig, vm.Config{})
-		if _, err := core.ApplyMessage(vmenv, msg, new(core.GasPool).AddGas(msg.GasLimit)); err != nil {
-			failed = err
-			break
+		snapshot := stateDB.Snapshot()
+		if traceCtx.Err() != nil {
+			results[i], err = applyTx(config.chainConfig, msg, txctx, blockCtx, stateDB, errBlockDeadline)
+		} else {
+			results[i], err = traceTx(traceCtx, config.chainConfig, msg, txctx, blockCtx, stateDB, config.callTracerConfig(),
+				config.options.txTimeout())
+		}
+		if err != nil {
+			if !config.options.ContinueOnError {
+				return nil, err
+			}
+			// Skip the transaction, as far as the state goes
+			stateDB.RevertToSnapshot(snapshot)
+			var txErr *TxTraceError
+			if !errors.As(err, &txErr) {
+				txErr = newTxTraceError(ErrKindExecution, i, tx.Hash(), err)
+			}
+			results[i] = &TxTraceResult{Error: txErr}
 		}
 		// Finalize the state so any modifications are written to the trie
 		// Only delete empty objects if EIP158/161 (a.k.a Spurious Dragon) is in effect
-		stateDB.Finalise(vmenv.ChainConfig().IsEIP158(block.Number()))
+		stateDB.Finalise(config.chainConfig.IsEIP158(block.Number()))
+		if verifier != nil {
+			verifier.addTx(stateDB, i, msg, results[i])
+		}
 	}
-	close(jobs)
-	pend.Wait()
+	// Apply the rewards and withdrawals so the post-block state matches the header
+	finalizeBlock(config, stateDB, block)
 
-	// If execution failed in between, abort
-	if failed != nil {
-		return nil, failed
+	if verifier != nil {
+		if divergence := verifier.verify(stateDB, results); divergence != nil {
+			config.options.OnDivergence(divergence)
+		}
 	}
+
 	return results, nil
 }
 
-// traceTx configures a new tracer according to the provided configuration, and
-// executes the given message in the provided environment. The return value will
-// be tracer dependent.
+// prepareSystemTx moves the fees collected on the system address to the
+// coinbase before a PoSA system transaction, as the engine does.
+func prepareSystemTx(engine consensus.Engine, statedb *state.StateDB, tx *types.Transaction, header *types.Header) {
+	posa, ok := engine.(PoSA)
+	if !ok {
+		return
+	}
+	if isSystem, _ := posa.IsSystemTransaction(tx, header); isSystem {
+		balance := statedb.GetBalance(SystemAddress)
+		if balance.Cmp(common.Big0) > 0 {
+			statedb.SetBalance(SystemAddress, big.NewInt(0))
+			statedb.AddBalance(header.Coinbase, balance)
+		}
+	}
+}
+
+// applyWithdrawals credits the beacon chain withdrawals of a block, the way
+// the consensus engine does in Finalize after all transactions.
+func applyWithdrawals(statedb *state.StateDB, withdrawals types.Withdrawals) {
+	for _, w := range withdrawals {
+		statedb.AddBalance(w.Address, mamoru.WithdrawalAmount(w))
+	}
+}
+
+// traceTx executes the given message in the provided environment with a
+// CallTracer and a StateDiffTracer attached. A *TxTraceError is returned only
+// if the message could not be executed, a tracer failure is reported in the
+// result.
 func traceTx(ctx context.Context,
 	chainConfig *params.ChainConfig,
 	message *core.Message,
 	txctx *tracers.Context,
 	vmctx vm.BlockContext,
 	statedb *state.StateDB,
-	engine consensus.Engine) ([]*mamoru.CallFrame, error) {
-	var (
-		err       error
-		timeout   = 15 * time.Second
-		txContext = core.NewEVMTxContext(message)
-	)
-	// Creating CallTracer
-	tracer := mamoru.NewCallTracer(true)
+	tracerConfig mamoru.CallTracerConfig,
+	timeout time.Duration) (*TxTraceResult, error) {
+	txContext := core.NewEVMTxContext(message)
+	// Creating CallTracer and StateDiffTracer
+	tracer := mamoru.NewCallTracerWithConfig(tracerConfig)
+	stateTracer := mamoru.NewStateDiffTracer()
 
 	deadlineCtx, cancel := context.WithTimeout(ctx, timeout)
 	go func() {
 		<-deadlineCtx.Done()
 		if errors.Is(deadlineCtx.Err(), context.DeadlineExceeded) {
-			tracer.Stop(errors.New("execution timeout"))
+			reason := errTxTimeout
+			if ctx.Err() != nil {
+				reason = errBlockDeadline
+			}
+			tracer.Stop(reason)
+			stateTracer.Stop(reason)
 		}
 	}()
 	defer cancel()
 
 	// Run the transaction with tracing enabled.
-	vmenv := vm.NewEVM(vmctx, txContext, statedb, chainConfig, vm.Config{Tracer: tracer, NoBaseFee: true})
+	snapshot := statedb.Snapshot()
+	vmenv := vm.NewEVM(vmctx, txContext, statedb, chainConfig, vm.Config{Tracer: mamoru.NewMuxTracer(tracer, stateTracer), NoBaseFee: true})
 
-	if posa, ok := engine.(PoSA); ok && message.From == vmctx.Coinbase &&
-		posa.IsSystemContract(message.To) && message.GasPrice.Cmp(big.NewInt(0)) == 0 {
-		balance := statedb.GetBalance(SystemAddress)
-		if balance.Cmp(common.Big0) > 0 {
-			statedb.SetBalance(SystemAddress, big.NewInt(0))
-			statedb.AddBalance(vmctx.Coinbase, balance)
+	// Call Prepare to clear out the statedb access list
+	statedb.SetTxContext(txctx.TxHash, txctx.TxIndex)
+	execution, err := applyMessage(vmenv, message, txctx, statedb)
+	if err != nil {
+		return nil, err
+	}
+	cancel()
+
+	frames, err := tracer.TakeResult()
+	if err == nil {
+		var diffs []*mamoru.TxStateDiff
+		diffs, err = stateTracer.TakeResult()
+		if err == nil {
+			result := &TxTraceResult{Result: frames, execution: execution}
+			for _, frame := range frames {
+				frame.TxHash = txctx.TxHash.String()
+			}
+			if len(diffs) > 0 {
+				diffs[0].TxHash = txctx.TxHash.String()
+				result.StateDiff = diffs[0]
+			}
+			return result, nil
 		}
 	}
 
-	// Call Prepare to clear out the statedb access list
+	// The interrupted tracer cancelled the execution, so redo it untraced
+	statedb.RevertToSnapshot(snapshot)
+	return applyTx(chainConfig, message, txctx, vmctx, statedb, err)
+}
+
+// applyTx executes the given message without tracers, for a transaction whose
+// tracing failed with traceErr.
+func applyTx(chainConfig *params.ChainConfig,
+	message *core.Message,
+	txctx *tracers.Context,
+	vmctx vm.BlockContext,
+	statedb *state.StateDB,
+	traceErr error) (*TxTraceResult, error) {
+	vmenv := vm.NewEVM(vmctx, core.NewEVMTxContext(message), statedb, chainConfig, vm.Config{NoBaseFee: true})
+
 	statedb.SetTxContext(txctx.TxHash, txctx.TxIndex)
-	if _, err = core.ApplyMessage(vmenv, message, new(core.GasPool).AddGas(message.GasLimit)); err != nil {
-		return nil, fmt.Errorf("tracing failed: %w", err)
+	execution, err := applyMessage(vmenv, message, txctx, statedb)
+	if err != nil {
+		return nil, err
 	}
 
-	return tracer.TakeResult()
+	return &TxTraceResult{
+		Error:     newTxTraceError(tracerErrorKind(traceErr), txctx.TxIndex, txctx.TxHash, traceErr),
+		execution: execution,
+	}, nil
+}
+
+// applyMessage executes message and classifies its failure. State the
+// StateDB failed to load takes precedence, as it may be the cause of any
+// other failure.
+func applyMessage(vmenv *vm.EVM, message *core.Message, txctx *tracers.Context, statedb *state.StateDB) (*core.ExecutionResult, error) {
+	execution, err := core.ApplyMessage(vmenv, message, new(core.GasPool).AddGas(message.GasLimit))
+	if dbErr := statedb.Error(); dbErr != nil {
+		return nil, newTxTraceError(ErrKindMissingState, txctx.TxIndex, txctx.TxHash, dbErr)
+	}
+	if err != nil {
+		return nil, newTxTraceError(messageErrorKind(err), txctx.TxIndex, txctx.TxHash, err)
+	}
+	return execution, nil
 }
@@ -0,0 +1,455 @@
+package call_tracer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testChainContext struct{}
+
+func (testChainContext) Engine() consensus.Engine { return ethash.NewFaker() }
+
+func (testChainContext) GetHeader(common.Hash, uint64) *types.Header { return nil }
+
+var counter = common.HexToAddress("0xc0")
+
+// counterCode increments slot 0 and logs the new value.
+var counterCode = []byte{
+	byte(vm.PUSH1), 0, byte(vm.SLOAD), byte(vm.PUSH1), 1, byte(vm.ADD), // sload(0) + 1
+	byte(vm.DUP1), byte(vm.PUSH1), 0, byte(vm.SSTORE), // sstore(0, v)
+	byte(vm.PUSH1), 0, byte(vm.MSTORE), // mstore(0, v)
+	byte(vm.PUSH1), 32, byte(vm.PUSH1), 0, byte(vm.LOG0), // log0(0, 32)
+	byte(vm.STOP),
+}
+
+// newTestBlock returns a state with a funded account and the counter
+// contract, and a block of n transactions from that account alternating
+// between value transfers and counter calls.
+func newTestBlock(t testing.TB, n int) (*state.StateDB, *types.Block) {
+	statedb, block, _ := newTestBlockWithKey(t, n)
+	return statedb, block
+}
+
+func newTestBlockWithKey(t testing.TB, n int) (*state.StateDB, *types.Block, *ecdsa.PrivateKey) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	key, _ := crypto.GenerateKey()
+	statedb.SetBalance(crypto.PubkeyToAddress(key.PublicKey), new(big.Int).Mul(big.NewInt(1000), big.NewInt(params.Ether)))
+	statedb.SetCode(counter, counterCode)
+	root, err := statedb.Commit(false)
+	require.NoError(t, err)
+	statedb, err = state.New(root, statedb.Database(), nil)
+	require.NoError(t, err)
+
+	header := &types.Header{
+		Number:     big.NewInt(1),
+		GasLimit:   uint64(n+1) * 100_000,
+		Difficulty: big.NewInt(1),
+		BaseFee:    big.NewInt(params.InitialBaseFee),
+		Coinbase:   common.HexToAddress("0xc01b"),
+	}
+	txs := make(types.Transactions, n)
+	for i := range txs {
+		txs[i] = newTestTx(key, uint64(i))
+	}
+	return statedb, types.NewBlock(header, txs, nil, nil, trie.NewStackTrie(nil)), key
+}
+
+func newTestTx(key *ecdsa.PrivateKey, nonce uint64) *types.Transaction {
+	to, value := counter, big.NewInt(0)
+	if nonce%2 == 0 {
+		to, value = common.BigToAddress(new(big.Int).SetUint64(nonce+1)), big.NewInt(1)
+	}
+	return types.MustSignNewTx(key, types.LatestSigner(params.TestChainConfig), &types.DynamicFeeTx{
+		ChainID:   params.TestChainConfig.ChainID,
+		Nonce:     nonce,
+		Gas:       100_000,
+		GasFeeCap: big.NewInt(2 * params.InitialBaseFee),
+		GasTipCap: big.NewInt(1),
+		To:        &to,
+		Value:     value,
+	})
+}
+
+// processBlock executes block the way the state processor does, without the
+// block reward, and returns the resulting root.
+func processBlock(t testing.TB, statedb *state.StateDB, block *types.Block) common.Hash {
+	root, _ := processBlockReceipts(t, statedb, block)
+	return root
+}
+
+func processBlockReceipts(t testing.TB, statedb *state.StateDB, block *types.Block) (common.Hash, types.Receipts) {
+	var (
+		gasUsed  uint64
+		gasPool  = new(core.GasPool).AddGas(block.GasLimit())
+		header   = block.Header()
+		receipts types.Receipts
+	)
+	for i, tx := range block.Transactions() {
+		statedb.SetTxContext(tx.Hash(), i)
+		receipt, err := core.ApplyTransaction(params.TestChainConfig, testChainContext{}, nil, gasPool, statedb, header, tx, &gasUsed, vm.Config{})
+		require.NoError(t, err)
+		receipts = append(receipts, receipt)
+	}
+	return statedb.IntermediateRoot(true), receipts
+}
+
+// sealTestBlock returns block with the post-state fields of the header set
+// from a reference execution on statedb, and the receipts.
+func sealTestBlock(t testing.TB, statedb *state.StateDB, block *types.Block) (*types.Block, types.Receipts) {
+	root, receipts := processBlockReceipts(t, statedb.Copy(), block)
+	header := block.Header()
+	header.Root = root
+	header.GasUsed = receipts[len(receipts)-1].CumulativeGasUsed
+	return types.NewBlock(header, block.Transactions(), nil, receipts, trie.NewStackTrie(nil)), receipts
+}
+
+func TestTraceBlock(t *testing.T) {
+	statedb, block := newTestBlock(t, 10)
+	want := processBlock(t, statedb.Copy(), block)
+
+	config := NewTracerConfig(statedb, params.TestChainConfig, testChainContext{})
+	results, err := TraceBlock(context.Background(), config, block)
+	require.NoError(t, err)
+
+	// The state was advanced by the traced execution alone
+	assert.Equal(t, want, statedb.IntermediateRoot(true))
+
+	require.Len(t, results, block.Transactions().Len())
+	for i, result := range results {
+		tx := block.Transactions()[i]
+		assert.Empty(t, result.Error)
+		require.Len(t, result.Result, 1)
+		assert.Equal(t, uint32(i), result.Result[0].TxIndex)
+		assert.Equal(t, tx.Hash().String(), result.Result[0].TxHash)
+		require.NotNil(t, result.StateDiff)
+		assert.Equal(t, tx.Hash().String(), result.StateDiff.TxHash)
+	}
+	// The counter calls see the writes of the previous ones
+	assert.Len(t, results[1].Result[0].Logs, 1)
+	assert.Equal(t, common.BigToHash(big.NewInt(1)), common.BytesToHash(results[1].Result[0].Logs[0].Data))
+	assert.Equal(t, common.BigToHash(big.NewInt(5)), common.BytesToHash(results[9].Result[0].Logs[0].Data))
+}
+
+func TestTraceBlock_Genesis(t *testing.T) {
+	statedb, _ := newTestBlock(t, 0)
+	config := NewTracerConfig(statedb, params.TestChainConfig, testChainContext{})
+	_, err := TraceBlock(context.Background(), config, types.NewBlockWithHeader(&types.Header{Number: big.NewInt(0)}))
+	assert.Error(t, err)
+}
+
+func TestTraceBlock_BlockDeadline(t *testing.T) {
+	statedb, block := newTestBlock(t, 4)
+	want := processBlock(t, statedb.Copy(), block)
+
+	config := NewTracerConfig(statedb, params.TestChainConfig, testChainContext{}).
+		WithOptions(Options{BlockDeadline: time.Nanosecond})
+	results, err := TraceBlock(context.Background(), config, block)
+	require.NoError(t, err)
+
+	// Nothing is traced, but the state is still advanced
+	assert.Equal(t, want, statedb.IntermediateRoot(true))
+	for _, result := range results {
+		require.NotNil(t, result.Error)
+		assert.Equal(t, ErrKindTimeout, result.Error.Kind)
+		assert.ErrorIs(t, result.Error, errBlockDeadline)
+		assert.Empty(t, result.Result)
+	}
+}
+
+func TestTraceBlock_Cancelled(t *testing.T) {
+	statedb, block := newTestBlock(t, 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := TraceBlock(ctx, NewTracerConfig(statedb, params.TestChainConfig, testChainContext{}), block)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestTraceBlock_SharedPool(t *testing.T) {
+	pool, err := NewPool(2)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		statedb, block := newTestBlock(t, 4)
+		config := NewTracerConfig(statedb, params.TestChainConfig, testChainContext{}).
+			WithOptions(Options{Pool: pool, TxTimeout: time.Minute})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results, err := TraceBlock(context.Background(), config, block)
+			assert.NoError(t, err)
+			assert.Len(t, results, 4)
+		}()
+	}
+	wg.Wait()
+
+	pool.Close()
+	statedb, block := newTestBlock(t, 1)
+	_, err = TraceBlock(context.Background(), NewTracerConfig(statedb, params.TestChainConfig, testChainContext{}).
+		WithOptions(Options{Pool: pool}), block)
+	assert.Error(t, err)
+}
+
+func TestTraceBlock_ContinueOnError(t *testing.T) {
+	statedb, block, key := newTestBlockWithKey(t, 4)
+	txs := block.Transactions()
+	// A nonce gap, as if the replayed state missed a transaction
+	gap := newTestTx(key, 10)
+	// Not enough gas for a plain transfer
+	lowGas := types.MustSignNewTx(key, types.LatestSigner(params.TestChainConfig), &types.DynamicFeeTx{
+		ChainID:   params.TestChainConfig.ChainID,
+		Nonce:     4,
+		Gas:       20_000,
+		GasFeeCap: big.NewInt(2 * params.InitialBaseFee),
+		To:        &counter,
+	})
+	block = types.NewBlock(block.Header(), types.Transactions{txs[0], txs[1], gap, txs[2], txs[3], lowGas},
+		nil, nil, trie.NewStackTrie(nil))
+
+	_, err := TraceBlock(context.Background(), NewTracerConfig(statedb.Copy(), params.TestChainConfig, testChainContext{}), block)
+	var txErr *TxTraceError
+	require.ErrorAs(t, err, &txErr)
+	assert.Equal(t, ErrKindConsensus, txErr.Kind)
+	assert.Equal(t, 2, txErr.TxIndex)
+	assert.ErrorIs(t, err, core.ErrNonceTooHigh)
+
+	config := NewTracerConfig(statedb, params.TestChainConfig, testChainContext{}).
+		WithOptions(Options{ContinueOnError: true})
+	results, err := TraceBlock(context.Background(), config, block)
+	require.NoError(t, err)
+	require.Len(t, results, 6)
+
+	errs := TraceErrors(results)
+	require.Len(t, errs, 2)
+	assert.Equal(t, ErrKindConsensus, errs[0].Kind)
+	assert.Equal(t, gap.Hash(), errs[0].TxHash)
+	assert.Equal(t, ErrKindIntrinsicGas, errs[1].Kind)
+	assert.Equal(t, 5, errs[1].TxIndex)
+	assert.Empty(t, results[2].Result)
+
+	// The transactions around the failed one are traced
+	for _, i := range []int{0, 1, 3, 4} {
+		assert.Nil(t, results[i].Error)
+		assert.Len(t, results[i].Result, 1)
+	}
+	assert.Equal(t, uint64(4), statedb.GetNonce(crypto.PubkeyToAddress(key.PublicKey)))
+}
+
+func TestTraceBlock_Verify(t *testing.T) {
+	statedb, block := newTestBlock(t, 6)
+	block, receipts := sealTestBlock(t, statedb, block)
+
+	var divergences []*Divergence
+	options := Options{OnDivergence: func(d *Divergence) { divergences = append(divergences, d) }}
+	trace := func(statedb *state.StateDB, options Options, receipts types.Receipts) {
+		config := NewTracerConfig(statedb, params.TestChainConfig, testChainContext{}).
+			WithOptions(options).
+			WithReceipts(receipts)
+		_, err := TraceBlock(context.Background(), config, block)
+		require.NoError(t, err)
+	}
+
+	trace(statedb.Copy(), options, nil)
+	assert.Empty(t, divergences)
+
+	// The replayed state misses a write to the counter, so its calls use
+	// less gas than on chain
+	missingWrite := statedb.Copy()
+	missingWrite.SetState(counter, common.Hash{}, common.BigToHash(big.NewInt(1)))
+	trace(missingWrite.Copy(), options, nil)
+	require.Len(t, divergences, 1)
+	divergence := divergences[0]
+	assert.Equal(t, block.NumberU64(), divergence.BlockNumber)
+	assert.Equal(t, block.Root(), divergence.ExpectedRoot)
+	assert.NotEqual(t, divergence.ExpectedRoot, divergence.Root)
+	assert.Equal(t, block.GasUsed(), divergence.ExpectedGasUsed)
+	assert.Less(t, divergence.GasUsed, divergence.ExpectedGasUsed)
+	assert.NotEqual(t, divergence.ExpectedReceiptRoot, divergence.ReceiptRoot)
+	// Without the canonical receipts nothing points at a transaction
+	assert.Equal(t, -1, divergence.TxIndex)
+
+	// The canonical receipts point at the first call of the counter
+	divergences = nil
+	trace(missingWrite.Copy(), options, receipts)
+	require.Len(t, divergences, 1)
+	assert.Equal(t, 1, divergences[0].TxIndex)
+	assert.Equal(t, block.Transactions()[1].Hash(), divergences[0].TxHash)
+	assert.Contains(t, divergences[0].Reason, "cumulative gas used")
+
+	// A transaction the replayed state rejects
+	divergences = nil
+	sender, _ := types.Sender(types.LatestSigner(params.TestChainConfig), block.Transactions()[0])
+	rejecting := statedb.Copy()
+	rejecting.SetNonce(sender, 1)
+	trace(rejecting, Options{OnDivergence: options.OnDivergence, ContinueOnError: true}, nil)
+	require.Len(t, divergences, 1)
+	assert.Equal(t, 0, divergences[0].TxIndex)
+	assert.Contains(t, divergences[0].Reason, core.ErrNonceTooLow.Error())
+}
+
+func TestTraceBlock_Cache(t *testing.T) {
+	statedb, block := newTestBlock(t, 4)
+	cache := NewCache(1)
+
+	// A cancelled trace is not cached
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := TraceBlock(ctx, NewTracerConfig(statedb.Copy(), params.TestChainConfig, testChainContext{}).
+		WithOptions(Options{Cache: cache}), block)
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Zero(t, cache.Len())
+
+	var divergences []*Divergence
+	options := Options{Cache: cache, OnDivergence: func(d *Divergence) { divergences = append(divergences, d) }}
+	first, err := TraceBlock(context.Background(), NewTracerConfig(statedb.Copy(), params.TestChainConfig, testChainContext{}).
+		WithOptions(options), block)
+	require.NoError(t, err)
+	// The header of the test block doesn't match its replay
+	require.Len(t, divergences, 1)
+
+	// Traced once, the state is left as is and the divergence reported again
+	second := statedb.Copy()
+	root := second.IntermediateRoot(true)
+	results, err := TraceBlock(context.Background(), NewTracerConfig(second, params.TestChainConfig, testChainContext{}).
+		WithOptions(options), block)
+	require.NoError(t, err)
+	assert.Equal(t, first, results)
+	assert.Equal(t, root, second.IntermediateRoot(true))
+	require.Len(t, divergences, 2)
+	assert.Same(t, divergences[0], divergences[1])
+
+	// Other settings are traced apart, evicting the block
+	results, err = TraceBlock(context.Background(), NewTracerConfig(statedb.Copy(), params.TestChainConfig, testChainContext{}).
+		WithStorage(true).
+		WithOptions(Options{Cache: cache}), block)
+	require.NoError(t, err)
+	assert.NotSame(t, first[0], results[0])
+	assert.Equal(t, 1, cache.Len())
+
+	// So are other error handling settings
+	other, err := TraceBlock(context.Background(), NewTracerConfig(statedb.Copy(), params.TestChainConfig, testChainContext{}).
+		WithStorage(true).
+		WithOptions(Options{Cache: cache, ContinueOnError: true}), block)
+	require.NoError(t, err)
+	assert.NotSame(t, results[0], other[0])
+}
+
+func TestCache_Panic(t *testing.T) {
+	_, block := newTestBlock(t, 1)
+	cache := NewCache(0)
+	config := &Config{}
+
+	started, waited := make(chan struct{}), make(chan error)
+	go func() {
+		<-started
+		_, err := cache.trace(context.Background(), config, block, func(*Config) ([]*TxTraceResult, error) {
+			return nil, nil
+		})
+		waited <- err
+	}()
+	assert.Panics(t, func() {
+		cache.trace(context.Background(), config, block, func(*Config) ([]*TxTraceResult, error) {
+			close(started)
+			time.Sleep(10 * time.Millisecond)
+			panic("boom")
+		})
+	})
+	// The waiting call traces the block itself
+	select {
+	case err := <-waited:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("waiting call hangs")
+	}
+	assert.Zero(t, cache.Len())
+}
+
+// traceBlockTwice is the former TraceBlock: every transaction is executed
+// once to advance the state and once more, on a copy of the state, by a
+// worker with the tracers attached.
+func traceBlockTwice(ctx context.Context, config *Config, block *types.Block) ([]*TxTraceResult, error) {
+	var (
+		signer   = types.MakeSigner(config.chainConfig, block.Number(), block.Time())
+		txs      = block.Transactions()
+		results  = make([]*TxTraceResult, len(txs))
+		stateDB  = config.stateDB
+		blockCtx = core.NewEVMBlockContext(block.Header(), config.chainContext, nil)
+
+		pend = new(sync.WaitGroup)
+		jobs = make(chan int, len(txs))
+	)
+	copies := make([]*state.StateDB, len(txs))
+	for th := 0; th < runtime.NumCPU(); th++ {
+		pend.Add(1)
+		go func() {
+			defer pend.Done()
+			for i := range jobs {
+				msg, _ := core.TransactionToMessage(txs[i], signer, block.BaseFee())
+				txctx := &tracers.Context{BlockHash: block.Hash(), TxIndex: i, TxHash: txs[i].Hash()}
+				res, err := traceTx(ctx, config.chainConfig, msg, txctx, blockCtx, copies[i], config.callTracerConfig(),
+					config.options.txTimeout())
+				if err != nil {
+					res = &TxTraceResult{Error: newTxTraceError(ErrKindExecution, i, txs[i].Hash(), err)}
+				}
+				results[i] = res
+			}
+		}()
+	}
+	var failed error
+	for i, tx := range txs {
+		copies[i] = stateDB.Copy()
+		jobs <- i
+
+		msg, _ := core.TransactionToMessage(tx, signer, block.BaseFee())
+		stateDB.SetTxContext(tx.Hash(), i)
+		vmenv := vm.NewEVM(blockCtx, core.NewEVMTxContext(msg), stateDB, config.chainConfig, vm.Config{})
+		if _, err := core.ApplyMessage(vmenv, msg, new(core.GasPool).AddGas(msg.GasLimit)); err != nil {
+			failed = err
+			break
+		}
+		stateDB.Finalise(true)
+	}
+	close(jobs)
+	pend.Wait()
+
+	return results, failed
+}
+
+func benchmarkTraceBlock(b *testing.B, n int, trace func(context.Context, *Config, *types.Block) ([]*TxTraceResult, error)) {
+	statedb, block := newTestBlock(b, n)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		config := NewTracerConfig(statedb.Copy(), params.TestChainConfig, testChainContext{})
+		if _, err := trace(context.Background(), config, block); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTraceBlock_100(b *testing.B)  { benchmarkTraceBlock(b, 100, TraceBlock) }
+func BenchmarkTraceBlock_1000(b *testing.B) { benchmarkTraceBlock(b, 1000, TraceBlock) }
+
+func BenchmarkTraceBlockTwice_100(b *testing.B)  { benchmarkTraceBlock(b, 100, traceBlockTwice) }
+func BenchmarkTraceBlockTwice_1000(b *testing.B) { benchmarkTraceBlock(b, 1000, traceBlockTwice) }
@@ -0,0 +1,220 @@
+package call_tracer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+)
+
+// OverrideAccount replaces parts of an account for TraceCall. Nil fields are
+// left as they are.
+type OverrideAccount struct {
+	Nonce     *uint64                     `json:"nonce,omitempty"`
+	Code      []byte                      `json:"code,omitempty"`
+	Balance   *big.Int                    `json:"balance,omitempty"`
+	State     map[common.Hash]common.Hash `json:"state,omitempty"`     // Replaces the whole storage
+	StateDiff map[common.Hash]common.Hash `json:"stateDiff,omitempty"` // Replaces the given slots
+}
+
+// StateOverride is the set of accounts replaced for TraceCall.
+type StateOverride map[common.Address]OverrideAccount
+
+// Apply writes the overrides to statedb.
+func (o StateOverride) Apply(statedb *state.StateDB) error {
+	for addr, account := range o {
+		if account.Nonce != nil {
+			statedb.SetNonce(addr, *account.Nonce)
+		}
+		if account.Code != nil {
+			statedb.SetCode(addr, account.Code)
+		}
+		if account.Balance != nil {
+			statedb.SetBalance(addr, account.Balance)
+		}
+		if account.State != nil && account.StateDiff != nil {
+			return fmt.Errorf("account %s has both 'state' and 'stateDiff'", addr.Hex())
+		}
+		if account.State != nil {
+			statedb.SetStorage(addr, account.State)
+		}
+		for key, value := range account.StateDiff {
+			statedb.SetState(addr, key, value)
+		}
+	}
+	// Now finalize the changes. Finalize is normally performed between
+	// transactions. By using finalize, the overrides are semantically behaving
+	// as if they were created in a transaction just before the tracing occur.
+	statedb.Finalise(false)
+	return nil
+}
+
+// TraceTransaction traces the transaction at txIndex of block. The state of
+// the config is the state before the block, the transactions before the
+// target are executed untraced, the ones after it not at all.
+func TraceTransaction(ctx context.Context,
+	config *Config,
+	block *types.Block,
+	txIndex int,
+) (*TxTraceResult, error) {
+	if block.NumberU64() == 0 {
+		return nil, errors.New("genesis is not traceable")
+	}
+	var (
+		result *TxTraceResult
+		err    error
+	)
+	if poolErr := config.run(func() {
+		result, err = traceTransaction(ctx, config, block, txIndex)
+	}); poolErr != nil {
+		return nil, poolErr
+	}
+
+	return result, err
+}
+
+func traceTransaction(ctx context.Context, config *Config, block *types.Block, txIndex int) (*TxTraceResult, error) {
+	var (
+		signer   = types.MakeSigner(config.chainConfig, block.Number(), block.Time())
+		txs      = block.Transactions()
+		stateDB  = config.stateDB
+		blockCtx = core.NewEVMBlockContext(block.Header(), config.chainContext, nil)
+	)
+	if txIndex < 0 || txIndex >= len(txs) {
+		return nil, fmt.Errorf("transaction %d not found in block %d", txIndex, block.NumberU64())
+	}
+	prepare := func(i int, tx *types.Transaction) (*core.Message, *tracers.Context, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		msg, err := core.TransactionToMessage(tx, signer, block.BaseFee())
+		if err != nil {
+			return nil, nil, newTxTraceError(ErrKindInvalidTx, i, tx.Hash(), err)
+		}
+		prepareSystemTx(config.engin, stateDB, tx, block.Header())
+		return msg, &tracers.Context{BlockHash: block.Hash(), TxIndex: i, TxHash: tx.Hash()}, nil
+	}
+
+	// Generate the state snapshot before the target fast without tracing
+	for i, tx := range txs[:txIndex] {
+		msg, txctx, err := prepare(i, tx)
+		if err != nil {
+			return nil, err
+		}
+		vmenv := vm.NewEVM(blockCtx, core.NewEVMTxContext(msg), stateDB, config.chainConfig, vm.Config{NoBaseFee: true})
+		stateDB.SetTxContext(txctx.TxHash, txctx.TxIndex)
+		if _, err := applyMessage(vmenv, msg, txctx, stateDB); err != nil {
+			return nil, err
+		}
+		stateDB.Finalise(config.chainConfig.IsEIP158(block.Number()))
+	}
+
+	msg, txctx, err := prepare(txIndex, txs[txIndex])
+	if err != nil {
+		return nil, err
+	}
+	return traceTx(ctx, config.chainConfig, msg, txctx, blockCtx, stateDB, config.callTracerConfig(),
+		config.options.txTimeout())
+}
+
+// TraceCall traces msg as if it was executed right after the block of
+// header, on the state of the config with overrides applied. Like eth_call,
+// the sender needs no funds unless a gas price is set, the gas limit defaults
+// to the block gas limit and the nonce is not checked.
+func TraceCall(ctx context.Context,
+	config *Config,
+	header *types.Header,
+	msg ethereum.CallMsg,
+	overrides StateOverride,
+) (*TxTraceResult, error) {
+	var (
+		result *TxTraceResult
+		err    error
+	)
+	if poolErr := config.run(func() {
+		result, err = traceCall(ctx, config, header, msg, overrides)
+	}); poolErr != nil {
+		return nil, poolErr
+	}
+
+	return result, err
+}
+
+func traceCall(ctx context.Context, config *Config, header *types.Header, msg ethereum.CallMsg, overrides StateOverride) (*TxTraceResult, error) {
+	stateDB := config.stateDB
+	if err := overrides.Apply(stateDB); err != nil {
+		return nil, err
+	}
+	message := callMessage(msg, header, stateDB)
+	blockCtx := core.NewEVMBlockContext(header, config.chainContext, nil)
+
+	result, err := traceTx(ctx, config.chainConfig, message, &tracers.Context{}, blockCtx, stateDB,
+		config.callTracerConfig(), config.options.txTimeout())
+	if err != nil {
+		return nil, err
+	}
+	// A call has no transaction
+	for _, frame := range result.Result {
+		frame.TxHash = ""
+	}
+	if result.StateDiff != nil {
+		result.StateDiff.TxHash = ""
+	}
+
+	return result, nil
+}
+
+// callMessage turns msg into a message the way eth_call does.
+func callMessage(msg ethereum.CallMsg, header *types.Header, statedb *state.StateDB) *core.Message {
+	gasLimit := msg.Gas
+	if gasLimit == 0 {
+		gasLimit = header.GasLimit
+	}
+	gasPrice, gasFeeCap, gasTipCap := new(big.Int), new(big.Int), new(big.Int)
+	switch {
+	case msg.GasPrice != nil:
+		gasPrice.Set(msg.GasPrice)
+		gasFeeCap.Set(msg.GasPrice)
+		gasTipCap.Set(msg.GasPrice)
+	case msg.GasFeeCap != nil || msg.GasTipCap != nil:
+		if msg.GasFeeCap != nil {
+			gasFeeCap.Set(msg.GasFeeCap)
+		}
+		if msg.GasTipCap != nil {
+			gasTipCap.Set(msg.GasTipCap)
+		}
+		// The effective price, as in core.TransactionToMessage
+		gasPrice.Set(gasFeeCap)
+		if header.BaseFee != nil && gasFeeCap.BitLen() > 0 {
+			gasPrice = gasPrice.Add(gasTipCap, header.BaseFee)
+			if gasPrice.Cmp(gasFeeCap) > 0 {
+				gasPrice.Set(gasFeeCap)
+			}
+		}
+	}
+	value := new(big.Int)
+	if msg.Value != nil {
+		value.Set(msg.Value)
+	}
+	return &core.Message{
+		From:              msg.From,
+		To:                msg.To,
+		Nonce:             statedb.GetNonce(msg.From),
+		Value:             value,
+		GasLimit:          gasLimit,
+		GasPrice:          gasPrice,
+		GasFeeCap:         gasFeeCap,
+		GasTipCap:         gasTipCap,
+		Data:              msg.Data,
+		AccessList:        msg.AccessList,
+		SkipAccountChecks: true,
+	}
+}
@@ -0,0 +1,81 @@
+package call_tracer
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceTransaction(t *testing.T) {
+	statedb, block := newTestBlock(t, 6)
+	results, err := TraceBlock(context.Background(), NewTracerConfig(statedb.Copy(), params.TestChainConfig, testChainContext{}), block)
+	require.NoError(t, err)
+
+	for _, txIndex := range []int{0, 3, 5} {
+		config := NewTracerConfig(statedb.Copy(), params.TestChainConfig, testChainContext{})
+		result, err := TraceTransaction(context.Background(), config, block, txIndex)
+		require.NoError(t, err)
+		assert.Equal(t, results[txIndex].Result, result.Result)
+		assert.Equal(t, results[txIndex].StateDiff, result.StateDiff)
+	}
+
+	_, err = TraceTransaction(context.Background(), NewTracerConfig(statedb.Copy(), params.TestChainConfig, testChainContext{}), block, 6)
+	assert.Error(t, err)
+}
+
+func TestTraceCall(t *testing.T) {
+	statedb, block := newTestBlock(t, 0)
+	header := block.Header()
+	caller := common.HexToAddress("0xca11")
+	// Calls the counter and returns
+	proxy := common.HexToAddress("0xa0")
+	proxyCode := []byte{0x60, 0, 0x60, 0, 0x60, 0, 0x60, 0, 0x60, 0, byte(vm.PUSH20)}
+	proxyCode = append(proxyCode, counter.Bytes()...)
+	proxyCode = append(proxyCode, byte(vm.GAS), byte(vm.CALL), byte(vm.STOP))
+
+	config := NewTracerConfig(statedb, params.TestChainConfig, testChainContext{})
+	result, err := TraceCall(context.Background(), config, header, ethereum.CallMsg{
+		From:     caller,
+		To:       &proxy,
+		GasPrice: big.NewInt(params.InitialBaseFee),
+	}, StateOverride{
+		caller:  {Balance: big.NewInt(params.Ether)},
+		proxy:   {Code: proxyCode},
+		counter: {StateDiff: map[common.Hash]common.Hash{{}: common.BigToHash(big.NewInt(41))}},
+	})
+	require.NoError(t, err)
+	assert.Nil(t, result.Error)
+
+	frames := result.Result
+	require.Len(t, frames, 2)
+	assert.Equal(t, "0x00000000000000000000000000000000000000a0", frames[0].To)
+	assert.Empty(t, frames[0].TxHash)
+	require.Len(t, frames[1].Logs, 1)
+	assert.Equal(t, common.BigToHash(big.NewInt(42)), common.BytesToHash(frames[1].Logs[0].Data))
+
+	require.NotNil(t, result.StateDiff)
+	var callerPaid bool
+	for _, account := range result.StateDiff.Accounts {
+		if account.Address == caller {
+			callerPaid = account.BalanceAfter.Cmp(account.BalanceBefore) < 0
+		}
+	}
+	assert.True(t, callerPaid)
+
+	// Without a gas price, the caller needs no funds
+	result, err = TraceCall(context.Background(), config, header, ethereum.CallMsg{From: common.HexToAddress("0xbeef"), To: &counter}, nil)
+	require.NoError(t, err)
+	assert.Empty(t, result.Result[0].Error)
+
+	_, err = TraceCall(context.Background(), config, header, ethereum.CallMsg{From: caller, To: &counter}, StateOverride{
+		counter: {State: map[common.Hash]common.Hash{}, StateDiff: map[common.Hash]common.Hash{}},
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,151 @@
+package call_tracer
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// Divergence reports a replayed block whose result doesn't match its header,
+// so its traces can't be trusted.
+type Divergence struct {
+	BlockNumber uint64      `json:"blockNumber"`
+	BlockHash   common.Hash `json:"blockHash"`
+
+	Root                common.Hash `json:"root"`
+	ExpectedRoot        common.Hash `json:"expectedRoot"`
+	GasUsed             uint64      `json:"gasUsed"`
+	ExpectedGasUsed     uint64      `json:"expectedGasUsed"`
+	ReceiptRoot         common.Hash `json:"receiptRoot"`
+	ExpectedReceiptRoot common.Hash `json:"expectedReceiptRoot"`
+
+	TxIndex int         `json:"txIndex"` // First diverging transaction, -1 if unknown
+	TxHash  common.Hash `json:"txHash"`
+	Reason  string      `json:"reason"` // How the first diverging transaction differs
+}
+
+func (d *Divergence) String() string {
+	s := fmt.Sprintf("block %d (%s) diverges: root %s, expected %s; gas used %d, expected %d; receipt root %s, expected %s",
+		d.BlockNumber, d.BlockHash, d.Root, d.ExpectedRoot, d.GasUsed, d.ExpectedGasUsed, d.ReceiptRoot, d.ExpectedReceiptRoot)
+	if d.TxIndex >= 0 {
+		s += fmt.Sprintf("; first at tx %d (%s): %s", d.TxIndex, d.TxHash, d.Reason)
+	}
+	return s
+}
+
+// blockVerifier rebuilds the receipts of a replayed block to check it against
+// the header.
+type blockVerifier struct {
+	config   *Config
+	block    *types.Block
+	gasUsed  uint64
+	receipts types.Receipts
+}
+
+// addTx records the receipt of the transaction at index i, once its state
+// changes are finalised. Skipped transactions have no receipt.
+func (v *blockVerifier) addTx(statedb *state.StateDB, i int, msg *core.Message, result *TxTraceResult) {
+	if result.execution == nil {
+		return
+	}
+	tx := v.block.Transactions()[i]
+	v.gasUsed += result.execution.UsedGas
+
+	receipt := &types.Receipt{Type: tx.Type(), CumulativeGasUsed: v.gasUsed}
+	if v.config.chainConfig.IsByzantium(v.block.Number()) {
+		receipt.Status = types.ReceiptStatusSuccessful
+		if result.execution.Failed() {
+			receipt.Status = types.ReceiptStatusFailed
+		}
+	} else {
+		receipt.PostState = statedb.IntermediateRoot(v.config.chainConfig.IsEIP158(v.block.Number())).Bytes()
+	}
+	receipt.TxHash = tx.Hash()
+	receipt.GasUsed = result.execution.UsedGas
+	if msg.To == nil {
+		receipt.ContractAddress = crypto.CreateAddress(msg.From, tx.Nonce())
+	}
+	receipt.Logs = statedb.GetLogs(tx.Hash(), v.block.NumberU64(), v.block.Hash())
+	receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
+	receipt.TransactionIndex = uint(i)
+	v.receipts = append(v.receipts, receipt)
+}
+
+// verify compares the replayed post-block state with the header and returns
+// the divergence, if any.
+func (v *blockVerifier) verify(statedb *state.StateDB, results []*TxTraceResult) *Divergence {
+	header := v.block.Header()
+	divergence := &Divergence{
+		BlockNumber:         header.Number.Uint64(),
+		BlockHash:           v.block.Hash(),
+		Root:                statedb.IntermediateRoot(v.config.chainConfig.IsEIP158(header.Number)),
+		ExpectedRoot:        header.Root,
+		GasUsed:             v.gasUsed,
+		ExpectedGasUsed:     header.GasUsed,
+		ReceiptRoot:         types.DeriveSha(v.receipts, trie.NewStackTrie(nil)),
+		ExpectedReceiptRoot: header.ReceiptHash,
+		TxIndex:             -1,
+	}
+	if divergence.Root == divergence.ExpectedRoot && divergence.GasUsed == divergence.ExpectedGasUsed &&
+		divergence.ReceiptRoot == divergence.ExpectedReceiptRoot {
+		return nil
+	}
+	divergence.TxIndex, divergence.Reason = v.firstDivergingTx(results)
+	if divergence.TxIndex >= 0 {
+		divergence.TxHash = v.block.Transactions()[divergence.TxIndex].Hash()
+	}
+	return divergence
+}
+
+// firstDivergingTx compares the rebuilt receipts with the canonical ones of
+// the config. Without those, the first transaction that failed to execute is
+// the best guess.
+func (v *blockVerifier) firstDivergingTx(results []*TxTraceResult) (int, string) {
+	if canonical := v.config.receipts; canonical != nil {
+		replayed := make(map[uint]*types.Receipt, len(v.receipts))
+		for _, receipt := range v.receipts {
+			replayed[receipt.TransactionIndex] = receipt
+		}
+		for i, want := range canonical {
+			got, ok := replayed[uint(i)]
+			switch {
+			case !ok:
+				return i, "not executed"
+			case got.Status != want.Status:
+				return i, fmt.Sprintf("status %d, expected %d", got.Status, want.Status)
+			case got.CumulativeGasUsed != want.CumulativeGasUsed:
+				return i, fmt.Sprintf("cumulative gas used %d, expected %d", got.CumulativeGasUsed, want.CumulativeGasUsed)
+			case len(got.Logs) != len(want.Logs):
+				return i, fmt.Sprintf("%d logs, expected %d", len(got.Logs), len(want.Logs))
+			case got.Bloom != want.Bloom:
+				return i, "logs bloom differs"
+			}
+		}
+	}
+	for i, result := range results {
+		if result != nil && result.Error != nil && result.Error.Kind != ErrKindTimeout {
+			return i, result.Error.Message
+		}
+	}
+	return -1, ""
+}
+
+// finalizeBlock applies what the consensus engine does after the
+// transactions, e.g. the block rewards and the withdrawals. PoSA engines
+// settle their rewards through system transactions of the block, and engines
+// need a header reader, so without one only the withdrawals are credited.
+func finalizeBlock(config *Config, statedb *state.StateDB, block *types.Block) {
+	if _, ok := config.engin.(PoSA); !ok && config.engin != nil {
+		if chain, ok := config.chainContext.(consensus.ChainHeaderReader); ok {
+			config.engin.Finalize(chain, block.Header(), statedb, block.Transactions(), block.Uncles(), block.Withdrawals())
+			return
+		}
+	}
+	applyWithdrawals(statedb, block.Withdrawals())
+}
@@ -0,0 +1,266 @@
+package mamoru
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/naoina/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	SinkChain  = "chain"  // The validation chain
+	SinkFile   = "file"   // A JSON-lines file, see FileSink
+	SinkOutbox = "outbox" // The validation chain behind an on-disk queue, see Outbox
+)
+
+// Contexts are the sniffer contexts a Config can enable.
+var Contexts = []string{CtxBlockchain, CtxLightchain, CtxLightTxpool, CtxTxpool, CtxBackfill, CtxReorg}
+
+// Duration is a time.Duration written as in "1m30s" in config files.
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// Config configures the SDK, as a section of the node config file. Without
+// one, the SDK reads the environment variables alone.
+type Config struct {
+	// Enabled turns the sniffer on, overridden by MAMORU_SNIFFER_ENABLE.
+	Enabled bool `yaml:"enabled"`
+	// SyncDelta is how many blocks behind the highest known block the node
+	// counts as synced, overridden by MAMORU_SNIFFER_SYNC_DELTA.
+	SyncDelta int64 `yaml:"syncDelta"`
+	// Contexts are the contexts blocks are sent in, all if empty,
+	// overridden by MAMORU_SNIFFER_CONTEXTS, comma separated.
+	Contexts []string `yaml:"contexts"`
+
+	Tracer  TracerConfig  `yaml:"tracer"`
+	Sinks   []SinkConfig  `yaml:"sinks"`
+	Filters FiltersConfig `yaml:"filters"`
+}
+
+// TracerConfig is how the pipelines trace blocks, see call_tracer.Options.
+type TracerConfig struct {
+	TxTimeout       Duration `yaml:"txTimeout" json:"txTimeout"`
+	BlockDeadline   Duration `yaml:"blockDeadline" json:"blockDeadline"`
+	Workers         int      `yaml:"workers" json:"workers"`
+	ContinueOnError bool     `yaml:"continueOnError" json:"continueOnError"`
+	WithStorage     bool     `yaml:"withStorage" json:"withStorage"`
+	Verify          bool     `yaml:"verify" json:"verify"`
+}
+
+// SinkConfig is a Sink blocks are sent to, see Config.OpenSink.
+type SinkConfig struct {
+	Type     string `yaml:"type"`     // SinkChain, SinkFile or SinkOutbox
+	Path     string `yaml:"path"`     // The file, or the outbox database
+	MaxBytes uint64 `yaml:"maxBytes"` // Disk cap of the outbox
+}
+
+// FiltersConfig trims the blocks sent.
+type FiltersConfig struct {
+	// Addresses keeps the transactions, events and call traces involving
+	// one of them, all if empty.
+	Addresses []common.Address `yaml:"addresses" json:"addresses"`
+}
+
+// DefaultConfig returns the config matching the defaults of the SDK.
+func DefaultConfig() *Config {
+	return &Config{
+		SyncDelta: Delta,
+		Tracer:    TracerConfig{ContinueOnError: true},
+	}
+}
+
+// LoadConfig reads the config at path, a TOML file or a YAML one if its
+// extension is .yaml or .yml, on top of DefaultConfig, then applies the
+// environment overrides and validates it.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := DefaultConfig()
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	default:
+		if err := tomlSettings.NewDecoder(bytes.NewReader(data)).Decode(cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if err := cfg.ApplyEnv(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// tomlSettings names the TOML keys after the Go fields, as the node config
+// file does.
+var tomlSettings = toml.Config{
+	NormFieldName: func(rt reflect.Type, key string) string {
+		return key
+	},
+	FieldToKey: func(rt reflect.Type, field string) string {
+		return field
+	},
+	MissingField: func(rt reflect.Type, field string) error {
+		return fmt.Errorf("field '%s' is not defined in %s", field, rt.String())
+	},
+}
+
+// ApplyEnv overrides the config with the environment variables set.
+func (c *Config) ApplyEnv() error {
+	if val, ok := os.LookupEnv("MAMORU_SNIFFER_ENABLE"); ok {
+		enabled, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("MAMORU_SNIFFER_ENABLE: %w", err)
+		}
+		c.Enabled = enabled
+	}
+	if val, ok := os.LookupEnv("MAMORU_SNIFFER_SYNC_DELTA"); ok {
+		delta, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return fmt.Errorf("MAMORU_SNIFFER_SYNC_DELTA: %w", err)
+		}
+		c.SyncDelta = delta
+	}
+	if val, ok := os.LookupEnv("MAMORU_SNIFFER_CONTEXTS"); ok {
+		c.Contexts = nil
+		for _, ctx := range strings.Split(val, ",") {
+			if ctx = strings.TrimSpace(ctx); ctx != "" {
+				c.Contexts = append(c.Contexts, ctx)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks the values of the config.
+func (c *Config) Validate() error {
+	if c.SyncDelta < 0 {
+		return fmt.Errorf("negative sync delta %d", c.SyncDelta)
+	}
+	for _, ctx := range c.Contexts {
+		if !knownContext(ctx) {
+			return fmt.Errorf("unknown context %q, expected one of %s", ctx, strings.Join(Contexts, ", "))
+		}
+	}
+	if c.Tracer.TxTimeout < 0 || c.Tracer.BlockDeadline < 0 {
+		return errors.New("negative tracer timeout")
+	}
+	if c.Tracer.Workers < 0 {
+		return fmt.Errorf("negative tracer workers %d", c.Tracer.Workers)
+	}
+	for i, sink := range c.Sinks {
+		switch sink.Type {
+		case SinkChain:
+		case SinkFile, SinkOutbox:
+			if sink.Path == "" {
+				return fmt.Errorf("sink %d: %s sink without a path", i, sink.Type)
+			}
+		default:
+			return fmt.Errorf("sink %d: unknown type %q", i, sink.Type)
+		}
+	}
+	return nil
+}
+
+// ContextEnabled reports whether blocks are sent in snifferContext.
+func (c *Config) ContextEnabled(snifferContext string) bool {
+	if len(c.Contexts) == 0 {
+		return true
+	}
+	for _, ctx := range c.Contexts {
+		if ctx == snifferContext {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenSink opens the sinks of the config, teed if there are several. It
+// returns a nil Sink without sinks, the validation chain by default, and a
+// func closing the files and databases opened.
+func (c *Config) OpenSink() (Sink, func() error, error) {
+	var (
+		sinks   []Sink
+		closers []func() error
+	)
+	closeAll := func() error {
+		var errs []error
+		for _, close := range closers {
+			if err := close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	}
+	for _, sink := range c.Sinks {
+		switch sink.Type {
+		case SinkChain:
+			sinks = append(sinks, NewChainSink(nil))
+		case SinkFile:
+			file, err := NewFileSink(sink.Path)
+			if err != nil {
+				closeAll()
+				return nil, nil, err
+			}
+			sinks = append(sinks, file)
+			closers = append(closers, file.Close)
+		case SinkOutbox:
+			outbox, err := OpenOutbox(sink.Path, NewChainSink(nil), OutboxOptions{MaxBytes: sink.MaxBytes})
+			if err != nil {
+				closeAll()
+				return nil, nil, err
+			}
+			sinks = append(sinks, outbox)
+			closers = append(closers, outbox.Close)
+		default:
+			closeAll()
+			return nil, nil, fmt.Errorf("unknown sink type %q", sink.Type)
+		}
+	}
+	switch len(sinks) {
+	case 0:
+		return nil, closeAll, nil
+	case 1:
+		return sinks[0], closeAll, nil
+	}
+	return Tee(sinks...), closeAll, nil
+}
+
+func knownContext(snifferContext string) bool {
+	for _, ctx := range Contexts {
+		if ctx == snifferContext {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package mamoru
+
+import (
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Mamoru-Foundation/mamoru-sniffer-go/mamoru_sniffer"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testConfigTOML = `
+Enabled = true
+SyncDelta = 4
+Contexts = ["blockchain", "txpool"]
+
+[Tracer]
+TxTimeout = "5s"
+Verify = true
+
+[[Sinks]]
+Type = "file"
+Path = "blocks.jsonl"
+
+[Filters]
+Addresses = ["0x00000000000000000000000000000000000000aa"]
+`
+
+const testConfigYAML = `
+enabled: true
+syncDelta: 4
+contexts: [blockchain, txpool]
+tracer:
+  txTimeout: 5s
+  verify: true
+sinks:
+  - type: file
+    path: blocks.jsonl
+filters:
+  addresses: ["0x00000000000000000000000000000000000000aa"]
+`
+
+func writeConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	for name, content := range map[string]string{"mamoru.toml": testConfigTOML, "mamoru.yaml": testConfigYAML} {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := LoadConfig(writeConfig(t, name, content))
+			require.NoError(t, err)
+			assert.Equal(t, &Config{
+				Enabled:   true,
+				SyncDelta: 4,
+				Contexts:  []string{CtxBlockchain, CtxTxpool},
+				Tracer:    TracerConfig{TxTimeout: Duration(5 * time.Second), ContinueOnError: true, Verify: true},
+				Sinks:     []SinkConfig{{Type: SinkFile, Path: "blocks.jsonl"}},
+				Filters:   FiltersConfig{Addresses: []common.Address{{19: 0xaa}}},
+			}, cfg)
+		})
+	}
+}
+
+func TestLoadConfig_Env(t *testing.T) {
+	t.Setenv("MAMORU_SNIFFER_ENABLE", "false")
+	t.Setenv("MAMORU_SNIFFER_SYNC_DELTA", "20")
+	t.Setenv("MAMORU_SNIFFER_CONTEXTS", "lightchain, lighttxpool")
+
+	cfg, err := LoadConfig(writeConfig(t, "mamoru.toml", testConfigTOML))
+	require.NoError(t, err)
+	assert.False(t, cfg.Enabled)
+	assert.Equal(t, int64(20), cfg.SyncDelta)
+	assert.Equal(t, []string{CtxLightchain, CtxLightTxpool}, cfg.Contexts)
+
+	t.Setenv("MAMORU_SNIFFER_CONTEXTS", "mempool")
+	_, err = LoadConfig(writeConfig(t, "mamoru.toml", testConfigTOML))
+	assert.ErrorContains(t, err, "unknown context")
+}
+
+func TestConfig_Validate(t *testing.T) {
+	for name, cfg := range map[string]*Config{
+		"negative delta":   {SyncDelta: -1},
+		"negative timeout": {Tracer: TracerConfig{TxTimeout: -1}},
+		"sink type":        {Sinks: []SinkConfig{{Type: "kafka"}}},
+		"sink path":        {Sinks: []SinkConfig{{Type: SinkOutbox}}},
+	} {
+		assert.Error(t, cfg.Validate(), name)
+	}
+	assert.NoError(t, DefaultConfig().Validate())
+
+	_, err := LoadConfig(writeConfig(t, "mamoru.yaml", "enable: true\n"))
+	assert.Error(t, err, "unknown field")
+}
+
+func TestSniffer_WithConfig(t *testing.T) {
+	connect := SnifferConnectFunc
+	defer func() { SnifferConnectFunc = connect }()
+	SnifferConnectFunc = func() (*mamoru_sniffer.Sniffer, error) { return nil, nil }
+	// The environment overrides the config
+	t.Setenv("MAMORU_SNIFFER_ENABLE", "true")
+
+	cfg := DefaultConfig()
+	cfg.Contexts = []string{CtxBlockchain}
+	cfg.Sinks = []SinkConfig{{Type: SinkFile, Path: filepath.Join(t.TempDir(), "blocks.jsonl")}}
+	s := NewSniffer(WithConfig(cfg))
+	defer s.Close()
+
+	assert.True(t, s.CheckRequirements())
+	assert.IsType(t, &FileSink{}, s.Sink())
+	assert.True(t, s.ContextEnabled(CtxBlockchain))
+	assert.False(t, s.ContextEnabled(CtxTxpool))
+
+	// Without config, everything is enabled
+	assert.True(t, NewSniffer().ContextEnabled(CtxTxpool))
+	s = NewSniffer(WithConfig(nil))
+	assert.Nil(t, s.Config())
+	assert.True(t, s.ContextEnabled(CtxTxpool))
+	// The config is copied
+	assert.False(t, cfg.Enabled)
+}
+
+func TestSniffer_WithConfig_Invalid(t *testing.T) {
+	t.Setenv("MAMORU_SNIFFER_ENABLE", "true")
+
+	// An invalid config disables the sniffer
+	cfg := DefaultConfig()
+	cfg.SyncDelta = -1
+	s := NewSniffer(WithConfig(cfg))
+	assert.False(t, s.Config().Enabled)
+	assert.False(t, s.CheckRequirements())
+
+	cfg = DefaultConfig()
+	cfg.Sinks = []SinkConfig{{Type: SinkFile}}
+	assert.False(t, NewSniffer(WithConfig(cfg)).CheckRequirements())
+
+	// As an invalid override
+	t.Setenv("MAMORU_SNIFFER_SYNC_DELTA", "-5")
+	assert.False(t, NewSniffer(WithConfig(DefaultConfig())).CheckRequirements())
+
+	// Or a sink that fails to open
+	t.Setenv("MAMORU_SNIFFER_SYNC_DELTA", "10")
+	cfg = DefaultConfig()
+	cfg.Sinks = []SinkConfig{{Type: SinkFile, Path: filepath.Join(t.TempDir(), "missing", "blocks.jsonl")}}
+	assert.False(t, NewSniffer(WithConfig(cfg)).CheckRequirements())
+}
+
+func TestTracer_Filters(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Filters.Addresses = []common.Address{{0xaa}}
+	watched := common.Address{0xaa}.Hex()
+
+	sink := &testSink{}
+	tracer := NewTracer(NewFeed(nil), WithTracerConfig(cfg))
+	tracer.SetSink(sink)
+	tracer.SetDeliveries(nil)
+	tracer.data.Transactions = []Transaction{{Transaction: mamoru_sniffer.Transaction{TxIndex: 0, From: watched}}, {}}
+	tracer.data.Events = []mamoru_sniffer.Event{{Address: watched}, {}}
+	tracer.data.CallTraces = []CallTrace{{CallTrace: mamoru_sniffer.CallTrace{TxIndex: 1}}, {CallTrace: mamoru_sniffer.CallTrace{To: watched}}}
+	tracer.data.Withdrawals = []Withdrawal{{Address: watched}, {Index: 1}}
+	tracer.Send(time.Now(), big.NewInt(1), common.Hash{0x01}, CtxBlockchain)
+
+	require.Len(t, sink.sent, 1)
+	ctx := sink.sent[0]
+	require.Len(t, ctx.Transactions, 1)
+	assert.Equal(t, uint32(0), ctx.Transactions[0].TxIndex)
+	assert.Len(t, ctx.Events, 1)
+	require.Len(t, ctx.CallTraces, 1)
+	assert.Equal(t, uint32(0), ctx.CallTraces[0].TxIndex)
+	require.Len(t, ctx.Withdrawals, 1)
+	assert.Equal(t, watched, ctx.Withdrawals[0].Address)
+}
@@ -0,0 +1,249 @@
+package mamoru
+
+import (
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// FinalityLabel is a beacon chain label a held block is sent once it covers.
+type FinalityLabel string
+
+const (
+	FinalityNone      FinalityLabel = ""
+	FinalitySafe      FinalityLabel = "safe"
+	FinalityFinalized FinalityLabel = "finalized"
+)
+
+// DefaultMaxHeld is the default number of blocks a Confirmer holds back, in
+// case the confirmation never comes, e.g. a finality label on a chain
+// before the merge.
+const DefaultMaxHeld = 1024
+
+var (
+	// ErrDroppedByReorg is reported by Confirmer.SendThen for a held block
+	// that left the canonical chain before it was confirmed.
+	ErrDroppedByReorg = errors.New("held block dropped by a reorg")
+	// ErrHeldEvicted is reported by Confirmer.SendThen for a held block
+	// evicted by newer ones past the cap, see Confirmer.SetMaxHeld.
+	ErrHeldEvicted = errors.New("held block evicted, too many blocks held")
+)
+
+// ConfirmationChain is the chain a Confirmer checks held blocks against.
+type ConfirmationChain interface {
+	CurrentHeader() *types.Header
+	// GetHeaderByNumber returns the canonical header at number.
+	GetHeaderByNumber(number uint64) *types.Header
+}
+
+// finalityChain is a ConfirmationChain that follows the beacon chain labels,
+// e.g. a *core.BlockChain.
+type finalityChain interface {
+	CurrentSafeBlock() *types.Header
+	CurrentFinalBlock() *types.Header
+}
+
+type heldBlock struct {
+	tracer         *Tracer
+	start          time.Time
+	number         *big.Int
+	hash           common.Hash
+	snifferContext string
+	done           func(error)
+	skip           error // Why the block is not sent, nil if it is
+}
+
+// Confirmer holds the finished blocks back until they are confirmed: block
+// N is sent once block N+depth is canonical, or once the finality label
+// covers it. A held block that leaves the canonical chain is dropped, it was
+// never sent. Without depth and label, blocks are sent right away.
+//
+// The blocks are sent outside of the lock, by the caller that confirmed
+// them, in order: a slow sink only delays that caller.
+type Confirmer struct {
+	chain ConfirmationChain
+	depth uint64
+	label FinalityLabel
+
+	mu      sync.Mutex
+	maxHeld int
+	held    []*heldBlock // By ascending number
+	settled []*heldBlock // Confirmed, dropped or evicted, to send or report
+	sending bool         // Whether a caller is going through settled
+
+	send func(*heldBlock) error
+}
+
+// NewConfirmer returns a Confirmer checking blocks against chain. The label
+// needs a chain following the beacon chain, it is ignored otherwise, e.g. on
+// a light chain.
+func NewConfirmer(chain ConfirmationChain, depth uint64, label FinalityLabel) *Confirmer {
+	if _, ok := chain.(finalityChain); !ok && label != FinalityNone {
+		log.Warn("Mamoru finality label not supported by the chain", "label", label)
+		label = FinalityNone
+	}
+	return &Confirmer{
+		chain:   chain,
+		depth:   depth,
+		label:   label,
+		maxHeld: DefaultMaxHeld,
+		send: func(block *heldBlock) error {
+			return block.tracer.Send(block.start, block.number, block.hash, block.snifferContext)
+		},
+	}
+}
+
+// Send holds the finished tracer of a block in place of Tracer.Send, then
+// sends the held blocks now confirmed.
+func (c *Confirmer) Send(tracer *Tracer, start time.Time, blockNumber *big.Int, blockHash common.Hash, snifferContext string) {
+	c.SendThen(tracer, start, blockNumber, blockHash, snifferContext, nil)
+}
+
+// SendThen is Send calling done once the block is sent, with the error of
+// Tracer.Send, or with ErrDroppedByReorg or ErrHeldEvicted if it is not.
+// done is called without the confirmer locked, possibly before SendThen
+// returns.
+func (c *Confirmer) SendThen(tracer *Tracer, start time.Time, blockNumber *big.Int, blockHash common.Hash, snifferContext string,
+	done func(error),
+) {
+	c.mu.Lock()
+	block := &heldBlock{tracer: tracer, start: start, number: blockNumber, hash: blockHash, snifferContext: snifferContext, done: done}
+	i := len(c.held)
+	for i > 0 && c.held[i-1].number.Cmp(blockNumber) > 0 {
+		i--
+	}
+	c.held = append(c.held, nil)
+	copy(c.held[i+1:], c.held[i:])
+	c.held[i] = block
+
+	c.flush()
+	c.evict()
+	c.mu.Unlock()
+
+	c.deliver()
+}
+
+// Flush sends the held blocks now confirmed, e.g. after the finality label
+// moved without a new block.
+func (c *Confirmer) Flush() {
+	c.mu.Lock()
+	c.flush()
+	c.mu.Unlock()
+
+	c.deliver()
+}
+
+// SetMaxHeld caps the number of blocks held back, DefaultMaxHeld by
+// default. Past it, the oldest blocks are evicted without being sent.
+func (c *Confirmer) SetMaxHeld(maxHeld int) {
+	c.mu.Lock()
+	c.maxHeld = maxHeld
+	c.evict()
+	c.mu.Unlock()
+
+	c.deliver()
+}
+
+// Held returns the number of blocks held back.
+func (c *Confirmer) Held() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.held)
+}
+
+// flush settles the held blocks now confirmed or dropped.
+func (c *Confirmer) flush() {
+	var (
+		head     = c.chain.CurrentHeader()
+		finality = c.finalized()
+		held     []*heldBlock
+	)
+	for i, block := range c.held {
+		number := block.number.Uint64()
+		if canonical := c.chain.GetHeaderByNumber(number); canonical == nil || canonical.Hash() != block.hash {
+			log.Info("Mamoru held block dropped by a reorg", "number", number, "hash", block.hash, "ctx", block.snifferContext)
+			block.skip = ErrDroppedByReorg
+			c.settled = append(c.settled, block)
+			continue
+		}
+		if !c.confirmed(number, head, finality) {
+			// The blocks after it are not confirmed either
+			held = append(held, c.held[i:]...)
+			break
+		}
+		c.settled = append(c.settled, block)
+	}
+	c.held = held
+}
+
+// evict settles the oldest held blocks past the cap.
+func (c *Confirmer) evict() {
+	if c.maxHeld <= 0 {
+		return
+	}
+	for len(c.held) > c.maxHeld {
+		block := c.held[0]
+		log.Warn("Mamoru held block evicted, too many blocks held", "number", block.number, "hash", block.hash,
+			"max", c.maxHeld, "ctx", block.snifferContext)
+		block.skip = ErrHeldEvicted
+		c.settled = append(c.settled, block)
+		c.held = c.held[1:]
+	}
+}
+
+// deliver sends the settled blocks in order, unlocked. Only one caller goes
+// through them at a time, the others leave theirs to it.
+func (c *Confirmer) deliver() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sending {
+		return
+	}
+	c.sending = true
+	for len(c.settled) > 0 {
+		block := c.settled[0]
+		c.settled = c.settled[1:]
+		c.mu.Unlock()
+
+		err := block.skip
+		if err == nil {
+			err = c.send(block)
+		}
+		if block.done != nil {
+			block.done(err)
+		}
+		c.mu.Lock()
+	}
+	c.sending = false
+}
+
+// confirmed reports whether block number may be sent.
+func (c *Confirmer) confirmed(number uint64, head, finality *types.Header) bool {
+	if c.depth == 0 && c.label == FinalityNone {
+		return true
+	}
+	if c.depth > 0 && head != nil && head.Number.Uint64() >= number+c.depth {
+		return true
+	}
+	return finality != nil && finality.Number.Uint64() >= number
+}
+
+// finalized returns the latest block covered by the label.
+func (c *Confirmer) finalized() *types.Header {
+	chain, ok := c.chain.(finalityChain)
+	if !ok {
+		return nil
+	}
+	switch c.label {
+	case FinalitySafe:
+		return chain.CurrentSafeBlock()
+	case FinalityFinalized:
+		return chain.CurrentFinalBlock()
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package mamoru
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+type testConfirmationChain struct {
+	canonical []*types.Header
+	final     *types.Header
+}
+
+func (c *testConfirmationChain) CurrentHeader() *types.Header {
+	return c.canonical[len(c.canonical)-1]
+}
+
+func (c *testConfirmationChain) GetHeaderByNumber(number uint64) *types.Header {
+	if number >= uint64(len(c.canonical)) {
+		return nil
+	}
+	return c.canonical[number]
+}
+
+func (c *testConfirmationChain) CurrentSafeBlock() *types.Header  { return c.final }
+func (c *testConfirmationChain) CurrentFinalBlock() *types.Header { return c.final }
+
+// extend adds a canonical block, of a fork if extra differs.
+func (c *testConfirmationChain) extend(extra byte) *types.Header {
+	header := &types.Header{Number: big.NewInt(int64(len(c.canonical))), Extra: []byte{extra}}
+	c.canonical = append(c.canonical, header)
+	return header
+}
+
+func newTestConfirmer(chain ConfirmationChain, depth uint64, label FinalityLabel) (*Confirmer, *[]uint64) {
+	confirmer := NewConfirmer(chain, depth, label)
+	sent := new([]uint64)
+	confirmer.send = func(block *heldBlock) error {
+		*sent = append(*sent, block.number.Uint64())
+		return nil
+	}
+	return confirmer, sent
+}
+
+func (c *Confirmer) sendHeader(header *types.Header) {
+	c.Send(NewTracer(NewFeed(nil)), time.Now(), header.Number, header.Hash(), CtxBlockchain)
+}
+
+func TestConfirmer_Depth(t *testing.T) {
+	chain := &testConfirmationChain{}
+	chain.extend(0)
+	confirmer, sent := newTestConfirmer(chain, 2, FinalityNone)
+
+	for i := 0; i < 3; i++ {
+		confirmer.sendHeader(chain.extend(0))
+	}
+	// Blocks 1 to 3, 1 is 2 deep
+	assert.Equal(t, []uint64{1}, *sent)
+	assert.Equal(t, 2, confirmer.Held())
+
+	// Block 3 is replaced by a fork, then confirmed
+	chain.canonical = chain.canonical[:3]
+	confirmer.sendHeader(chain.extend(1))
+	confirmer.sendHeader(chain.extend(1))
+	assert.Equal(t, []uint64{1, 2}, *sent)
+	assert.Equal(t, 2, confirmer.Held())
+
+	confirmer.sendHeader(chain.extend(1))
+	assert.Equal(t, []uint64{1, 2, 3}, *sent)
+}
+
+func TestConfirmer_Finality(t *testing.T) {
+	chain := &testConfirmationChain{}
+	chain.extend(0)
+	confirmer, sent := newTestConfirmer(chain, 0, FinalityFinalized)
+
+	for i := 0; i < 3; i++ {
+		confirmer.sendHeader(chain.extend(0))
+	}
+	assert.Empty(t, *sent)
+
+	chain.final = chain.canonical[2]
+	confirmer.Flush()
+	assert.Equal(t, []uint64{1, 2}, *sent)
+	assert.Equal(t, 1, confirmer.Held())
+}
+
+func TestConfirmer_Immediate(t *testing.T) {
+	chain := &testConfirmationChain{}
+	chain.extend(0)
+	confirmer, sent := newTestConfirmer(chain, 0, FinalityNone)
+
+	confirmer.sendHeader(chain.extend(0))
+	assert.Equal(t, []uint64{1}, *sent)
+	assert.Zero(t, confirmer.Held())
+}
+
+func TestConfirmer_SendThen(t *testing.T) {
+	chain := &testConfirmationChain{}
+	chain.extend(0)
+	confirmer, _ := newTestConfirmer(chain, 1, FinalityNone)
+
+	var results []error
+	sendThen := func(header *types.Header) {
+		confirmer.SendThen(NewTracer(NewFeed(nil)), time.Now(), header.Number, header.Hash(), CtxBlockchain, func(err error) {
+			results = append(results, err)
+		})
+	}
+	sendThen(chain.extend(0))
+	assert.Empty(t, results)
+
+	// Block 1 is replaced by a fork, then its replacement is confirmed
+	chain.canonical = chain.canonical[:1]
+	sendThen(chain.extend(1))
+	assert.Equal(t, []error{ErrDroppedByReorg}, results)
+	sendThen(chain.extend(1))
+	assert.Equal(t, []error{ErrDroppedByReorg, nil}, results)
+}
+
+func TestConfirmer_Unlocked(t *testing.T) {
+	chain := &testConfirmationChain{}
+	chain.extend(0)
+	confirmer := NewConfirmer(chain, 0, FinalityNone)
+
+	// The sink and done run with the confirmer unlocked
+	var held []int
+	confirmer.send = func(*heldBlock) error {
+		held = append(held, confirmer.Held())
+		return nil
+	}
+	header := chain.extend(0)
+	confirmer.SendThen(NewTracer(NewFeed(nil)), time.Now(), header.Number, header.Hash(), CtxBlockchain, func(err error) {
+		assert.NoError(t, err)
+		confirmer.Flush()
+	})
+	assert.Equal(t, []int{0}, held)
+}
+
+func TestConfirmer_MaxHeld(t *testing.T) {
+	chain := &testConfirmationChain{}
+	chain.extend(0)
+	// The label never moves
+	confirmer, sent := newTestConfirmer(chain, 0, FinalityFinalized)
+	confirmer.SetMaxHeld(2)
+
+	var results []error
+	for i := 0; i < 3; i++ {
+		header := chain.extend(0)
+		confirmer.SendThen(NewTracer(NewFeed(nil)), time.Now(), header.Number, header.Hash(), CtxBlockchain, func(err error) {
+			results = append(results, err)
+		})
+	}
+	assert.Equal(t, []error{ErrHeldEvicted}, results)
+	assert.Equal(t, 2, confirmer.Held())
+	assert.Empty(t, *sent)
+
+	confirmer.SetMaxHeld(1)
+	assert.Equal(t, []error{ErrHeldEvicted, ErrHeldEvicted}, results)
+
+	chain.final = chain.CurrentHeader()
+	confirmer.Flush()
+	assert.Equal(t, []uint64{3}, *sent)
+	assert.Equal(t, []error{ErrHeldEvicted, ErrHeldEvicted, nil}, results)
+}
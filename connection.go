@@ -0,0 +1,267 @@
+package mamoru
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Mamoru-Foundation/mamoru-sniffer-go/mamoru_sniffer"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+const (
+	DefaultConnMinBackoff       = time.Second
+	DefaultConnMaxBackoff       = 5 * time.Minute
+	DefaultConnProbeInterval    = 30 * time.Second
+	DefaultConnMaxProbeFailures = 3
+)
+
+// ErrConnBackoff is returned by Connection.Connect while waiting to retry a
+// failed connection.
+var ErrConnBackoff = errors.New("waiting to reconnect to the validation chain")
+
+// SnifferProbeFunc checks the health of a connected client, if set. The
+// validation chain client has no health call, so it is nil by default: the
+// health of a client then comes from the sends of the chain sinks, see
+// ConnOptions.MaxProbeFailures.
+var SnifferProbeFunc func(*mamoru_sniffer.Sniffer) error
+
+// ConnState is the state of a Connection.
+type ConnState int
+
+const (
+	ConnDisconnected ConnState = iota // Not connected, or waiting to retry
+	ConnConnecting                    // Connecting
+	ConnReady                         // Connected and healthy
+	ConnDegraded                      // Connected, but the last probe failed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnDisconnected:
+		return "disconnected"
+	case ConnConnecting:
+		return "connecting"
+	case ConnReady:
+		return "ready"
+	case ConnDegraded:
+		return "degraded"
+	}
+	return "unknown"
+}
+
+// ConnStateChange is sent to the subscribers of a Connection on every change
+// of its state.
+type ConnStateChange struct {
+	From, To ConnState
+	Err      error // Why the connection failed or degraded, if it did
+}
+
+// ConnOptions tune a Connection, the zero values stand for the defaults.
+type ConnOptions struct {
+	// MinBackoff and MaxBackoff bound the wait before a failed connection is
+	// retried, doubling from one to the other, with jitter.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// ProbeInterval is the minimum time between two health probes of the
+	// client, see SnifferProbeFunc.
+	ProbeInterval time.Duration
+	// MaxProbeFailures is the number of successive failed probes or sends
+	// after which the client is dropped and connected again.
+	MaxProbeFailures int
+}
+
+// Connection manages the connection to the validation chain: it connects on
+// demand, retries a failed connection with an exponential backoff and
+// jitter, probes the health of the client and reconnects once it is
+// unhealthy. The client is shared by every Connection.
+type Connection struct {
+	options ConnOptions
+
+	mu            sync.Mutex
+	state         ConnState
+	backoff       time.Duration
+	retryAt       time.Time
+	probedAt      time.Time
+	probeFailures int
+
+	feed event.Feed
+}
+
+// defaultConnection is the Connection of the chain sinks not set on a
+// Sniffer, e.g. the default sink of a Tracer.
+var defaultConnection = NewConnection(ConnOptions{})
+
+// NewConnection returns a disconnected Connection.
+func NewConnection(opts ConnOptions) *Connection {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = DefaultConnMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = DefaultConnMaxBackoff
+		if opts.MaxBackoff < opts.MinBackoff {
+			opts.MaxBackoff = opts.MinBackoff
+		}
+	}
+	if opts.ProbeInterval <= 0 {
+		opts.ProbeInterval = DefaultConnProbeInterval
+	}
+	if opts.MaxProbeFailures <= 0 {
+		opts.MaxProbeFailures = DefaultConnMaxProbeFailures
+	}
+	return &Connection{options: opts}
+}
+
+// State returns the current state.
+func (c *Connection) State() ConnState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// SubscribeStateChange registers a subscription of ConnStateChange. The
+// channel should be drained, the changes are sent synchronously.
+func (c *Connection) SubscribeStateChange(ch chan<- ConnStateChange) event.Subscription {
+	return c.feed.Subscribe(ch)
+}
+
+// Connect returns nil if the client is ready or degraded, probing it once
+// the probe interval elapsed. Otherwise it connects, unless it failed to
+// lately, then it returns ErrConnBackoff until the backoff elapsed.
+func (c *Connection) Connect() error {
+	var changes []ConnStateChange
+	defer c.notify(&changes)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	setState := func(state ConnState, err error) {
+		c.setState(&changes, state, err)
+	}
+
+	now := time.Now()
+	if c.state == ConnReady || c.state == ConnDegraded {
+		client := connectedClient()
+		// A client made by a mock can't be kept
+		if client != nil {
+			if SnifferProbeFunc == nil || now.Sub(c.probedAt) < c.options.ProbeInterval {
+				return nil
+			}
+			c.probedAt = now
+			if c.checkHealth(&changes, client, SnifferProbeFunc(client)) {
+				return nil
+			}
+			// Unhealthy, connect again right away
+		}
+	}
+	if now.Before(c.retryAt) {
+		return ErrConnBackoff
+	}
+
+	setState(ConnConnecting, nil)
+	if err := connectClient(); err != nil {
+		if c.backoff == 0 {
+			c.backoff = c.options.MinBackoff
+		}
+		// Between half and all of the backoff
+		wait := c.backoff/2 + time.Duration(rand.Int63n(int64(c.backoff/2)+1))
+		c.retryAt = now.Add(wait)
+		if c.backoff *= 2; c.backoff > c.options.MaxBackoff {
+			c.backoff = c.options.MaxBackoff
+		}
+		erst := strings.Replace(err.Error(), "\t", "", -1)
+		erst = strings.Replace(erst, "\n", "", -1)
+		log.Error("Mamoru Sniffer connect", "err", erst, "retry", wait)
+		setState(ConnDisconnected, err)
+		return err
+	}
+	c.backoff = 0
+	c.retryAt = time.Time{}
+	c.probedAt = now
+	setState(ConnReady, nil)
+
+	return nil
+}
+
+// report records the outcome of a send to client, which counts as a probe
+// of a ready or degraded connection.
+func (c *Connection) report(client *mamoru_sniffer.Sniffer, err error) {
+	var changes []ConnStateChange
+	defer c.notify(&changes)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == ConnReady || c.state == ConnDegraded {
+		c.checkHealth(&changes, client, err)
+	}
+}
+
+// checkHealth records the outcome of a probe or a send, err is nil if it
+// succeeded. The client is dropped after MaxProbeFailures successive
+// failures, then it returns false.
+func (c *Connection) checkHealth(changes *[]ConnStateChange, client *mamoru_sniffer.Sniffer, err error) bool {
+	switch {
+	case err == nil:
+		c.probeFailures = 0
+		c.setState(changes, ConnReady, nil)
+		return true
+	case c.probeFailures+1 < c.options.MaxProbeFailures:
+		c.probeFailures++
+		c.setState(changes, ConnDegraded, err)
+		return true
+	}
+	dropClient(client)
+	c.probeFailures = 0
+	c.setState(changes, ConnDisconnected, err)
+	return false
+}
+
+// setState moves the connection to state, recording the change to send to
+// the subscribers once unlocked.
+func (c *Connection) setState(changes *[]ConnStateChange, state ConnState, err error) {
+	if state == c.state {
+		return
+	}
+	log.Info("Mamoru Sniffer connection", "from", c.state, "to", state, "err", err)
+	*changes = append(*changes, ConnStateChange{From: c.state, To: state, Err: err})
+	c.state = state
+}
+
+func (c *Connection) notify(changes *[]ConnStateChange) {
+	for _, change := range *changes {
+		c.feed.Send(change)
+	}
+}
+
+// connectedClient returns the shared client, nil if not connected.
+func connectedClient() *mamoru_sniffer.Sniffer {
+	connectMu.Lock()
+	defer connectMu.Unlock()
+	return sniffer
+}
+
+// connectClient connects the shared client, unless it is already.
+func connectClient() error {
+	connectMu.Lock()
+	defer connectMu.Unlock()
+	if sniffer != nil {
+		return nil
+	}
+	client, err := SnifferConnectFunc()
+	if err != nil {
+		return err
+	}
+	sniffer = client
+	return nil
+}
+
+// dropClient forgets the shared client, unless it was replaced already.
+func dropClient(client *mamoru_sniffer.Sniffer) {
+	connectMu.Lock()
+	defer connectMu.Unlock()
+	if sniffer == client {
+		sniffer = nil
+	}
+}
@@ -0,0 +1,121 @@
+package mamoru
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Mamoru-Foundation/mamoru-sniffer-go/mamoru_sniffer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockConnect makes the connections succeed with a fake client once up.
+func mockConnect(t *testing.T) (up *bool, dials *int) {
+	connect, probe := SnifferConnectFunc, SnifferProbeFunc
+	t.Cleanup(func() {
+		SnifferConnectFunc, SnifferProbeFunc = connect, probe
+		sniffer = nil
+	})
+	up, dials = new(bool), new(int)
+	SnifferConnectFunc = func() (*mamoru_sniffer.Sniffer, error) {
+		*dials++
+		if !*up {
+			return nil, errors.New("unreachable")
+		}
+		return &mamoru_sniffer.Sniffer{}, nil
+	}
+	return up, dials
+}
+
+func drainChanges(ch chan ConnStateChange) []ConnState {
+	var states []ConnState
+	for {
+		select {
+		case change := <-ch:
+			states = append(states, change.To)
+		default:
+			return states
+		}
+	}
+}
+
+func TestConnection_Backoff(t *testing.T) {
+	up, dials := mockConnect(t)
+	conn := NewConnection(ConnOptions{MinBackoff: 20 * time.Millisecond, MaxBackoff: 40 * time.Millisecond})
+	changes := make(chan ConnStateChange, 10)
+	sub := conn.SubscribeStateChange(changes)
+	defer sub.Unsubscribe()
+
+	assert.Error(t, conn.Connect())
+	assert.Equal(t, ConnDisconnected, conn.State())
+	// No retry before the backoff elapsed
+	assert.ErrorIs(t, conn.Connect(), ErrConnBackoff)
+	assert.Equal(t, 1, *dials)
+
+	*up = true
+	require.Eventually(t, func() bool { return conn.Connect() == nil }, time.Second, time.Millisecond)
+	assert.Equal(t, ConnReady, conn.State())
+	assert.Equal(t, 2, *dials)
+	assert.Equal(t, []ConnState{ConnConnecting, ConnDisconnected, ConnConnecting, ConnReady}, drainChanges(changes))
+
+	// Connected already
+	require.NoError(t, conn.Connect())
+	assert.Equal(t, 2, *dials)
+}
+
+func TestConnection_Probe(t *testing.T) {
+	up, dials := mockConnect(t)
+	*up = true
+	healthy := true
+	SnifferProbeFunc = func(*mamoru_sniffer.Sniffer) error {
+		if healthy {
+			return nil
+		}
+		return errors.New("unhealthy")
+	}
+	conn := NewConnection(ConnOptions{ProbeInterval: time.Nanosecond, MaxProbeFailures: 2})
+	changes := make(chan ConnStateChange, 10)
+	sub := conn.SubscribeStateChange(changes)
+	defer sub.Unsubscribe()
+
+	require.NoError(t, conn.Connect())
+	assert.Equal(t, ConnReady, conn.State())
+
+	// Degraded, but still usable
+	healthy = false
+	require.NoError(t, conn.Connect())
+	assert.Equal(t, ConnDegraded, conn.State())
+
+	// Dropped after the second failure, and connected again
+	require.NoError(t, conn.Connect())
+	assert.Equal(t, ConnReady, conn.State())
+	assert.Equal(t, 2, *dials)
+	assert.Equal(t, []ConnState{ConnConnecting, ConnReady, ConnDegraded, ConnDisconnected, ConnConnecting, ConnReady},
+		drainChanges(changes))
+}
+
+func TestConnection_Report(t *testing.T) {
+	up, dials := mockConnect(t)
+	*up = true
+	conn := NewConnection(ConnOptions{ProbeInterval: time.Nanosecond, MaxProbeFailures: 2})
+	sink := NewChainSink(nil)
+	sink.(connectionBinder).bindConnection(conn)
+
+	require.NoError(t, conn.Connect())
+	// No probe by default
+	require.NoError(t, conn.Connect())
+	assert.Equal(t, 1, *dials)
+
+	// The client went away, the sends fail
+	sniffer = nil
+	assert.ErrorIs(t, sink.Send(&EvmCtx{}), ErrNotConnected)
+	assert.Equal(t, ConnDegraded, conn.State())
+	assert.ErrorIs(t, sink.Send(&EvmCtx{}), ErrNotConnected)
+	assert.Equal(t, ConnDisconnected, conn.State())
+
+	// Connected again right away
+	require.NoError(t, conn.Connect())
+	assert.Equal(t, ConnReady, conn.State())
+	assert.Equal(t, 2, *dials)
+}
@@ -0,0 +1,152 @@
+package mamoru
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// Pipelines are the pipelines a Controller pauses and reconfigures, named
+// after the context they send blocks in.
+var Pipelines = []string{CtxBlockchain, CtxLightchain, CtxTxpool, CtxLightTxpool}
+
+// ErrUnknownPipeline is returned by the Controller for a pipeline not in
+// Pipelines.
+var ErrUnknownPipeline = errors.New("unknown pipeline")
+
+// PipelineConfig is the part of the Config a pipeline is reconfigured with
+// at runtime.
+type PipelineConfig struct {
+	Tracer  TracerConfig  `json:"tracer"`
+	Filters FiltersConfig `json:"filters"`
+}
+
+// PipelineStatus is the runtime state of a pipeline.
+type PipelineStatus struct {
+	Pipeline string          `json:"pipeline"`
+	Paused   bool            `json:"paused"`
+	Config   *PipelineConfig `json:"config,omitempty"` // The reconfiguration, nil if none
+}
+
+// Controller pauses, resumes and reconfigures the pipelines at runtime,
+// independently of each other. The pipelines read it once at the start of a
+// block, see Sniffer.ContextEnabled and Sniffer.BlockConfig: a change takes
+// effect from the next block, the block in flight is traced and sent as it
+// started.
+type Controller struct {
+	mu      sync.RWMutex
+	paused  map[string]bool
+	configs map[string]*PipelineConfig
+}
+
+// DefaultController is the Controller of the sniffers made without
+// WithController, so that the pipelines of a node share one.
+var DefaultController = NewController()
+
+// NewController returns a Controller with every pipeline running as
+// configured.
+func NewController() *Controller {
+	return &Controller{
+		paused:  make(map[string]bool),
+		configs: make(map[string]*PipelineConfig),
+	}
+}
+
+// Pause stops the pipeline from sending blocks, from the next one.
+func (c *Controller) Pause(pipeline string) error {
+	if err := checkPipeline(pipeline); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused[pipeline] = true
+	log.Info("Mamoru pipeline paused", "ctx", pipeline)
+	return nil
+}
+
+// Resume makes a paused pipeline send blocks again, from the next one.
+func (c *Controller) Resume(pipeline string) error {
+	if err := checkPipeline(pipeline); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.paused, pipeline)
+	log.Info("Mamoru pipeline resumed", "ctx", pipeline)
+	return nil
+}
+
+// Paused reports whether the pipeline is paused.
+func (c *Controller) Paused(pipeline string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.paused[pipeline]
+}
+
+// Reconfigure replaces the tracer options and the filters of the pipeline
+// with cfg from the next block, or restores those of the sniffer config if
+// cfg is nil.
+func (c *Controller) Reconfigure(pipeline string, cfg *PipelineConfig) error {
+	if err := checkPipeline(pipeline); err != nil {
+		return err
+	}
+	if cfg != nil {
+		if err := (&Config{Tracer: cfg.Tracer}).Validate(); err != nil {
+			return err
+		}
+		cfg = cfg.copy()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cfg == nil {
+		delete(c.configs, pipeline)
+	} else {
+		c.configs[pipeline] = cfg
+	}
+	log.Info("Mamoru pipeline reconfigured", "ctx", pipeline, "reset", cfg == nil)
+	return nil
+}
+
+// PipelineConfig returns a copy of the reconfiguration of the pipeline, nil
+// if it runs as configured.
+func (c *Controller) PipelineConfig(pipeline string) *PipelineConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.configs[pipeline].copy()
+}
+
+// Status returns the state of every pipeline, in the order of Pipelines.
+func (c *Controller) Status() []PipelineStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	status := make([]PipelineStatus, 0, len(Pipelines))
+	for _, pipeline := range Pipelines {
+		status = append(status, PipelineStatus{
+			Pipeline: pipeline,
+			Paused:   c.paused[pipeline],
+			Config:   c.configs[pipeline].copy(),
+		})
+	}
+	return status
+}
+
+func (p *PipelineConfig) copy() *PipelineConfig {
+	if p == nil {
+		return nil
+	}
+	cfg := *p
+	cfg.Filters.Addresses = append(cfg.Filters.Addresses[:0:0], p.Filters.Addresses...)
+	return &cfg
+}
+
+func checkPipeline(pipeline string) error {
+	for _, p := range Pipelines {
+		if p == pipeline {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w %q, expected one of %s", ErrUnknownPipeline, pipeline, strings.Join(Pipelines, ", "))
+}
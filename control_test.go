@@ -0,0 +1,114 @@
+package mamoru
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestController(t *testing.T) {
+	c := NewController()
+	s := NewSniffer(WithController(c))
+
+	require.NoError(t, c.Pause(CtxTxpool))
+	assert.False(t, s.ContextEnabled(CtxTxpool))
+	assert.True(t, s.ContextEnabled(CtxBlockchain))
+	// Other sniffers follow their own controller
+	assert.True(t, NewSniffer(WithController(NewController())).ContextEnabled(CtxTxpool))
+
+	require.NoError(t, c.Resume(CtxTxpool))
+	assert.True(t, s.ContextEnabled(CtxTxpool))
+
+	assert.ErrorIs(t, c.Pause("mempool"), ErrUnknownPipeline)
+	assert.ErrorIs(t, c.Pause(CtxBackfill), ErrUnknownPipeline)
+	assert.Error(t, c.Reconfigure(CtxTxpool, &PipelineConfig{Tracer: TracerConfig{Workers: -1}}))
+}
+
+func TestSniffer_BlockConfig(t *testing.T) {
+	c := NewController()
+	cfg := DefaultConfig()
+	cfg.Contexts = []string{CtxLightTxpool}
+	s := &Sniffer{config: cfg, controller: c}
+	assert.Same(t, cfg, s.BlockConfig(CtxLightTxpool))
+
+	override := &PipelineConfig{
+		Tracer:  TracerConfig{TxTimeout: Duration(time.Second), Verify: true},
+		Filters: FiltersConfig{Addresses: []common.Address{{0xaa}}},
+	}
+	require.NoError(t, c.Reconfigure(CtxLightTxpool, override))
+	// The controller keeps a copy
+	override.Filters.Addresses[0] = common.Address{0xbb}
+
+	block := s.BlockConfig(CtxLightTxpool)
+	assert.Equal(t, TracerConfig{TxTimeout: Duration(time.Second), Verify: true}, block.Tracer)
+	assert.Equal(t, []common.Address{{0xaa}}, block.Filters.Addresses)
+	assert.Equal(t, cfg.Contexts, block.Contexts)
+	assert.Same(t, cfg, s.BlockConfig(CtxLightchain))
+	// Without a config, on top of the defaults
+	assert.Equal(t, Delta, int((&Sniffer{controller: c}).BlockConfig(CtxLightTxpool).SyncDelta))
+
+	require.NoError(t, c.Reconfigure(CtxLightTxpool, nil))
+	assert.Same(t, cfg, s.BlockConfig(CtxLightTxpool))
+}
+
+func TestControlAPI(t *testing.T) {
+	c := NewController()
+	server := rpc.NewServer()
+	defer server.Stop()
+	for _, api := range APIs(c) {
+		require.NoError(t, server.RegisterName(api.Namespace, api.Service))
+	}
+	client := rpc.DialInProc(server)
+	defer client.Close()
+
+	require.NoError(t, client.Call(nil, "mamoru_pause", CtxLightchain))
+	assert.True(t, c.Paused(CtxLightchain))
+	assert.Error(t, client.Call(nil, "mamoru_pause", "mempool"))
+
+	var cfg struct {
+		Tracer struct {
+			TxTimeout string `json:"txTimeout"`
+		} `json:"tracer"`
+	}
+	cfg.Tracer.TxTimeout = "3s"
+	require.NoError(t, client.Call(nil, "mamoru_reconfigure", CtxTxpool, cfg))
+	assert.Equal(t, &PipelineConfig{Tracer: TracerConfig{TxTimeout: Duration(3 * time.Second)}}, c.PipelineConfig(CtxTxpool))
+
+	var status []PipelineStatus
+	require.NoError(t, client.Call(&status, "mamoru_status"))
+	assert.Equal(t, []PipelineStatus{
+		{Pipeline: CtxBlockchain},
+		{Pipeline: CtxLightchain, Paused: true},
+		{Pipeline: CtxTxpool, Config: c.PipelineConfig(CtxTxpool)},
+		{Pipeline: CtxLightTxpool},
+	}, status)
+
+	require.NoError(t, client.Call(nil, "mamoru_resume", CtxLightchain))
+	require.NoError(t, client.Call(nil, "mamoru_reconfigure", CtxTxpool, nil))
+	assert.False(t, c.Paused(CtxLightchain))
+	assert.Nil(t, c.PipelineConfig(CtxTxpool))
+}
+
+func TestControlAPI_HTTP(t *testing.T) {
+	c := NewController()
+	server := rpc.NewServer()
+	defer server.Stop()
+	for _, api := range APIs(c) {
+		// Registered as the admin namespace, behind --http.api rather than the auth port
+		assert.False(t, api.Authenticated)
+		require.NoError(t, server.RegisterName(api.Namespace, api.Service))
+	}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	client, err := rpc.Dial(httpServer.URL)
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.Call(nil, "mamoru_pause", CtxTxpool))
+	assert.True(t, c.Paused(CtxTxpool))
+}
@@ -0,0 +1,141 @@
+package mamoru
+
+import (
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// DefaultDeliveriesSize is the number of blocks a Deliveries made with a
+// size of zero remembers.
+const DefaultDeliveriesSize = 1024
+
+// DefaultDeliveries is the Deliveries tracers record their sends in, unless
+// set otherwise with Tracer.SetDeliveries.
+var DefaultDeliveries = NewDeliveries(DefaultDeliveriesSize)
+
+// deliveryState is the state of a block sent in a context.
+type deliveryState int
+
+const (
+	deliveryPending deliveryState = iota // Being sent
+	deliveryAcked                        // Handed over to the sniffer
+)
+
+// Deliveries records the blocks sent, keyed by block hash and context, so a
+// block is sent once per context. CtxLightchain and CtxLightTxpool carry the
+// same block and share a key. CtxTxpool is not recorded: the txpool sniffer
+// sends a batch of pending transactions per event, on the same head. A
+// retraction notice has a key of its own, clearing the other sends of the
+// block, so the block is sent again if it comes back to the canonical chain,
+// and vice versa.
+//
+// Only the last size blocks are remembered, in memory: after a restart the
+// delivered checkpoint of the catch-up bounds the blocks sent again.
+type Deliveries struct {
+	mu     sync.Mutex
+	size   int
+	blocks map[common.Hash]map[string]deliveryState
+	order  []common.Hash // Oldest first
+}
+
+// NewDeliveries returns a Deliveries remembering the last size blocks, or
+// DefaultDeliveriesSize if size is not positive.
+func NewDeliveries(size int) *Deliveries {
+	if size <= 0 {
+		size = DefaultDeliveriesSize
+	}
+	return &Deliveries{size: size, blocks: make(map[common.Hash]map[string]deliveryState)}
+}
+
+// Delivered reports whether the block of blockHash was sent, or is being
+// sent, in snifferContext. A pipeline checks it before tracing a block, to
+// skip the work.
+func (d *Deliveries) Delivered(blockHash common.Hash, snifferContext string) bool {
+	key := deliveryKey(snifferContext, false)
+	if key == "" {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.blocks[blockHash][key]
+	return ok
+}
+
+// Acknowledged reports whether the block of blockHash was handed over to
+// the sink in snifferContext, unlike Delivered not while it is being sent.
+func (d *Deliveries) Acknowledged(blockHash common.Hash, snifferContext string) bool {
+	key := deliveryKey(snifferContext, false)
+	if key == "" {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	state, ok := d.blocks[blockHash][key]
+	return ok && state == deliveryAcked
+}
+
+// claim marks the block as being sent with key, unless it was already.
+func (d *Deliveries) claim(blockHash common.Hash, key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	keys, ok := d.blocks[blockHash]
+	if !ok {
+		keys = make(map[string]deliveryState)
+		d.blocks[blockHash] = keys
+		d.order = append(d.order, blockHash)
+		for len(d.order) > d.size {
+			delete(d.blocks, d.order[0])
+			d.order = d.order[1:]
+		}
+	}
+	if _, ok := keys[key]; ok {
+		return false
+	}
+	keys[key] = deliveryPending
+	return true
+}
+
+// acknowledge records the block as sent with key. A retraction clears the
+// other sends of the block, a send clears the retraction.
+func (d *Deliveries) acknowledge(blockHash common.Hash, key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	keys, ok := d.blocks[blockHash]
+	if !ok {
+		// Evicted while being sent
+		return
+	}
+	for k := range keys {
+		if (k == BlockStatusRetracted) != (key == BlockStatusRetracted) {
+			delete(keys, k)
+		}
+	}
+	keys[key] = deliveryAcked
+}
+
+// release forgets a claim of a block that was not sent.
+func (d *Deliveries) release(blockHash common.Hash, key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if keys, ok := d.blocks[blockHash]; ok && keys[key] == deliveryPending {
+		delete(keys, key)
+	}
+}
+
+// deliveryKey returns the key of a send in snifferContext, empty if the send
+// is not deduplicated.
+func deliveryKey(snifferContext string, retracted bool) string {
+	switch {
+	case retracted:
+		return BlockStatusRetracted
+	case snifferContext == CtxLightTxpool:
+		return CtxLightchain
+	case snifferContext == CtxTxpool:
+		return ""
+	}
+	return snifferContext
+}
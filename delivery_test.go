@@ -0,0 +1,78 @@
+package mamoru
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveries(t *testing.T) {
+	deliveries := NewDeliveries(2)
+	send := func(hash common.Hash, snifferContext string, retracted bool) bool {
+		key := deliveryKey(snifferContext, retracted)
+		if !deliveries.claim(hash, key) {
+			return false
+		}
+		deliveries.acknowledge(hash, key)
+		return true
+	}
+	a, b, c := common.Hash{0x0a}, common.Hash{0x0b}, common.Hash{0x0c}
+
+	assert.True(t, send(a, CtxLightchain, false))
+	assert.True(t, deliveries.Delivered(a, CtxLightchain))
+	assert.True(t, deliveries.Acknowledged(a, CtxLightTxpool))
+	// The light txpool sends the same block
+	assert.True(t, deliveries.Delivered(a, CtxLightTxpool))
+	assert.False(t, send(a, CtxLightTxpool, false))
+	assert.True(t, send(a, CtxReorg, false))
+
+	// Retracted, then back to the canonical chain
+	assert.True(t, send(a, CtxReorg, true))
+	assert.False(t, send(a, CtxReorg, true))
+	assert.False(t, deliveries.Delivered(a, CtxReorg))
+	assert.True(t, send(a, CtxReorg, false))
+	assert.True(t, send(a, CtxReorg, true))
+
+	// A claim not sent is released
+	assert.True(t, deliveries.claim(b, CtxBlockchain))
+	assert.True(t, deliveries.Delivered(b, CtxBlockchain))
+	assert.False(t, deliveries.Acknowledged(b, CtxBlockchain))
+	deliveries.release(b, CtxBlockchain)
+	assert.False(t, deliveries.Delivered(b, CtxBlockchain))
+
+	// Only the last 2 blocks are remembered
+	assert.True(t, send(c, CtxBlockchain, false))
+	assert.False(t, deliveries.Delivered(a, CtxReorg))
+	assert.True(t, send(a, CtxReorg, true))
+}
+
+func TestTracer_SendUnsent(t *testing.T) {
+	deliveries := NewDeliveries(0)
+	hash := common.Hash{0x01}
+
+	// Without a sniffer the block is not sent, nor recorded
+	tracer := NewTracer(NewFeed(nil))
+	tracer.SetDeliveries(deliveries)
+	assert.ErrorIs(t, tracer.Send(time.Now(), big.NewInt(1), hash, CtxBlockchain), ErrNotConnected)
+	assert.False(t, deliveries.Delivered(hash, CtxBlockchain))
+}
+
+func TestTracer_SendTxpoolBatches(t *testing.T) {
+	deliveries := NewDeliveries(0)
+	sink := &testSink{}
+	head := common.Hash{0x01}
+
+	// The txpool sniffer sends a batch per event on the same head
+	for i := 0; i < 3; i++ {
+		tracer := NewTracer(NewFeed(nil))
+		tracer.SetSink(sink)
+		tracer.SetDeliveries(deliveries)
+		tracer.SetTxpoolCtx()
+		tracer.Send(time.Now(), big.NewInt(1), head, CtxTxpool)
+	}
+	assert.Len(t, sink.sent, 3)
+	assert.False(t, deliveries.Delivered(head, CtxTxpool))
+}
@@ -1,9 +1,11 @@
 package mamoru
 
 import (
-	"github.com/Mamoru-Foundation/mamoru-sniffer-go/mamoru_sniffer"
 	"math/big"
 
+	"github.com/Mamoru-Foundation/mamoru-sniffer-go/mamoru_sniffer"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/params"
@@ -12,15 +14,52 @@ import (
 var _ Feeder = &EthFeed{}
 
 type EthFeed struct {
-	chainConfig *params.ChainConfig
+	chainConfig  *params.ChainConfig
+	chain        ChainReader
+	legacyValues bool
+}
+
+// ChainReader gives EthFeed access to chain data that is not part of the
+// block itself.
+type ChainReader interface {
+	Engine() consensus.Engine
+	GetTd(hash common.Hash, number uint64) *big.Int
 }
 
-func NewFeed(chainConfig *params.ChainConfig) Feeder {
-	return &EthFeed{chainConfig: chainConfig}
+// FeedOption customizes an EthFeed.
+type FeedOption func(*EthFeed)
+
+// WithLegacyValues makes the feed fill the uint64 wire fields the way it used
+// to, wrapping amounts above 2^64 instead of saturating them. The lossless
+// Big fields are populated either way.
+func WithLegacyValues() FeedOption {
+	return func(f *EthFeed) {
+		f.legacyValues = true
+	}
 }
 
-func (f *EthFeed) FeedBlock(block *types.Block) mamoru_sniffer.Block {
-	var blockData mamoru_sniffer.Block
+// WithChain lets the feed look up total difficulty and the consensus engine.
+// Without it the engine is inferred from the chain config and total
+// difficulty is left unset.
+func WithChain(chain ChainReader) FeedOption {
+	return func(f *EthFeed) {
+		f.chain = chain
+	}
+}
+
+func NewFeed(chainConfig *params.ChainConfig, opts ...FeedOption) Feeder {
+	f := &EthFeed{chainConfig: chainConfig}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// FeedBlock maps the block header. The receipts are used to sum up the
+// priority fees that make up the block reward together with the static
+// consensus reward.
+func (f *EthFeed) FeedBlock(block *types.Block, receipts types.Receipts) Block {
+	var blockData Block
 	blockData.BlockIndex = block.NumberU64()
 	blockData.Hash = block.Hash().String()
 	blockData.ParentHash = block.ParentHash().String()
@@ -28,28 +67,54 @@ func (f *EthFeed) FeedBlock(block *types.Block) mamoru_sniffer.Block {
 	blockData.Nonce = block.Nonce()
 	blockData.Status = ""
 	blockData.Timestamp = block.Time()
-	blockData.BlockReward = block.Coinbase().Bytes()
-	blockData.FeeRecipient = block.ReceiptHash().String()
-	blockData.TotalDifficulty = block.Difficulty().Uint64()
+	blockData.FeeRecipient = block.Coinbase().String()
 	blockData.Size = float64(block.Size())
 	blockData.GasUsed = block.GasUsed()
 	blockData.GasLimit = block.GasLimit()
 
+	blockData.DifficultyBig = NewBigInt(block.Difficulty())
+	blockData.PostMerge = isPostMerge(f.chainConfig, block.Header())
+	if f.chain != nil {
+		if td := f.chain.GetTd(block.Hash(), block.NumberU64()); td != nil {
+			blockData.TotalDifficulty = toUint64(td, f.legacyValues)
+			blockData.TotalDifficultyBig = NewBigInt(td)
+		}
+	}
+	blockData.BaseFeeBig = NewBigInt(block.BaseFee())
+	blockData.MixDigest = block.MixDigest().String()
+	blockData.ExtraData = block.Extra()
+	blockData.TxCount = uint32(len(block.Transactions()))
+	blockData.UncleCount = uint32(len(block.Uncles()))
+
+	var engine consensus.Engine
+	if f.chain != nil {
+		engine = f.chain.Engine()
+	}
+	reward := computeBlockReward(f.chainConfig, engine, block, receipts)
+	blockData.BlockReward = reward.total().Bytes()
+	blockData.BlockRewardBig = NewBigInt(reward.total())
+	blockData.StaticRewardBig = NewBigInt(reward.static)
+	blockData.PriorityFeesBig = NewBigInt(reward.priority)
+
 	return blockData
 }
 
-func (f *EthFeed) FeedTransactions(blockNumber *big.Int, blockTime uint64, txs types.Transactions, receipts types.Receipts) []mamoru_sniffer.Transaction {
+// FeedTransactions maps txs and their receipts. Gas and fee amounts follow
+// EIP-1559 accounting against baseFee, which is nil for pre-London blocks.
+func (f *EthFeed) FeedTransactions(blockNumber *big.Int, blockTime uint64, baseFee *big.Int, txs types.Transactions, receipts types.Receipts) []Transaction {
 	signer := types.MakeSigner(f.chainConfig, blockNumber, blockTime)
-	var transactions []mamoru_sniffer.Transaction
+	var transactions []Transaction
 
 	for i, tx := range txs {
-		var transaction mamoru_sniffer.Transaction
+		var transaction Transaction
 		transaction.TxIndex = uint32(i)
 		transaction.TxHash = tx.Hash().String()
 		transaction.Type = tx.Type()
 		transaction.Nonce = tx.Nonce()
+		var receipt *types.Receipt
 		if receipts.Len() > i {
-			transaction.Status = receipts[i].Status
+			receipt = receipts[i]
+			transaction.Status = receipt.Status
 		}
 		transaction.BlockIndex = blockNumber.Uint64()
 		address, err := types.Sender(signer, tx)
@@ -60,11 +125,22 @@ func (f *EthFeed) FeedTransactions(blockNumber *big.Int, blockTime uint64, txs t
 		if tx.To() != nil {
 			transaction.To = tx.To().String()
 		}
-		transaction.Value = tx.Value().Uint64()
-		transaction.Fee = tx.GasFeeCap().Uint64()
-		transaction.GasPrice = tx.GasPrice().Uint64()
+		transaction.Value = toUint64(tx.Value(), f.legacyValues)
+		transaction.ValueBig = NewBigInt(tx.Value())
+		transaction.GasFeeCapBig = NewBigInt(tx.GasFeeCap())
+		transaction.GasTipCapBig = NewBigInt(tx.GasTipCap())
 		transaction.GasLimit = tx.Gas()
-		transaction.GasUsed = tx.Cost().Uint64()
+
+		fees := computeTxFees(tx, baseFee, receipt)
+		transaction.GasPrice = toUint64(fees.gasPrice, f.legacyValues)
+		transaction.GasPriceBig = NewBigInt(fees.gasPrice)
+		if receipt != nil {
+			transaction.GasUsed = receipt.GasUsed
+			transaction.Fee = toUint64(fees.total, f.legacyValues)
+			transaction.FeeBig = NewBigInt(fees.total)
+			transaction.PriorityFeeBig = NewBigInt(fees.priority)
+			transaction.BurntFeeBig = NewBigInt(fees.burnt)
+		}
 		transaction.Size = float64(tx.Size())
 		transaction.Input = tx.Data()
 
@@ -74,19 +150,68 @@ func (f *EthFeed) FeedTransactions(blockNumber *big.Int, blockTime uint64, txs t
 	return transactions
 }
 
-func (f *EthFeed) FeedCallTraces(callFrames []*CallFrame, blockNumber uint64) []mamoru_sniffer.CallTrace {
-	var callTraces []mamoru_sniffer.CallTrace
-	for i, frame := range callFrames {
-		var callTrace mamoru_sniffer.CallTrace
-		callTrace.TxIndex = uint32(i)
+// txFees is the EIP-1559 breakdown of what a transaction paid.
+type txFees struct {
+	gasPrice *big.Int // effective price per gas
+	priority *big.Int // tip paid to the fee recipient
+	burnt    *big.Int // base fee burnt
+	total    *big.Int // priority + burnt
+}
+
+// computeTxFees derives the effective gas price of tx under baseFee and, when
+// a receipt is known, the fees actually paid for the gas it used.
+func computeTxFees(tx *types.Transaction, baseFee *big.Int, receipt *types.Receipt) txFees {
+	var fees txFees
+	burntPerGas := new(big.Int)
+	if baseFee == nil {
+		fees.gasPrice = new(big.Int).Set(tx.GasPrice())
+	} else {
+		fees.gasPrice = new(big.Int).Add(baseFee, tx.GasTipCap())
+		if fees.gasPrice.Cmp(tx.GasFeeCap()) > 0 {
+			fees.gasPrice.Set(tx.GasFeeCap())
+		}
+		burntPerGas.Set(baseFee)
+		// Replays without base fee enforcement may underpay the base fee.
+		if burntPerGas.Cmp(fees.gasPrice) > 0 {
+			burntPerGas.Set(fees.gasPrice)
+		}
+	}
+	if receipt == nil {
+		return fees
+	}
+	gasUsed := new(big.Int).SetUint64(receipt.GasUsed)
+	fees.total = new(big.Int).Mul(gasUsed, fees.gasPrice)
+	fees.burnt = new(big.Int).Mul(gasUsed, burntPerGas)
+	fees.priority = new(big.Int).Sub(fees.total, fees.burnt)
+
+	return fees
+}
+
+func (f *EthFeed) FeedCallTraces(callFrames []*CallFrame, blockNumber uint64) []CallTrace {
+	var callTraces []CallTrace
+	for _, frame := range callFrames {
+		var callTrace CallTrace
+		callTrace.Seq = frame.Index
+		callTrace.ParentSeq = frame.ParentIndex
+		callTrace.TraceAddress = frame.TraceAddress
+		callTrace.Depth = frame.Depth
+		callTrace.TxIndex = frame.TxIndex
+		callTrace.TxHash = frame.TxHash
 		callTrace.BlockIndex = blockNumber
 		callTrace.Type = frame.Type
 		callTrace.To = frame.To
 		callTrace.From = frame.From
-		callTrace.Value = frame.Value
+		callTrace.Value = toUint64(frame.Value, f.legacyValues)
+		callTrace.ValueBig = NewBigInt(frame.Value)
 		callTrace.GasLimit = frame.Gas
 		callTrace.GasUsed = frame.GasUsed
 		callTrace.Input = frame.Input
+		callTrace.Output = frame.Output
+		callTrace.Error = frame.Error
+		callTrace.Reverted = frame.Reverted
+		callTrace.Revert = frame.Revert
+		callTrace.Logs = frame.Logs
+		callTrace.Storage = frame.Storage
 
 		callTraces = append(callTraces, callTrace)
 	}
@@ -94,6 +219,56 @@ func (f *EthFeed) FeedCallTraces(callFrames []*CallFrame, blockNumber uint64) []
 	return callTraces
 }
 
+func (f *EthFeed) FeedWithdrawals(withdrawals types.Withdrawals, blockNumber uint64) []Withdrawal {
+	var out []Withdrawal
+	for _, w := range withdrawals {
+		var withdrawal Withdrawal
+		withdrawal.Index = w.Index
+		withdrawal.ValidatorIndex = w.Validator
+		withdrawal.BlockIndex = blockNumber
+		withdrawal.Address = w.Address.String()
+		withdrawal.Amount = w.Amount
+		amount := WithdrawalAmount(w)
+		withdrawal.AmountBig = NewBigInt(amount)
+		withdrawal.Value = toUint64(amount, f.legacyValues)
+
+		out = append(out, withdrawal)
+	}
+
+	return out
+}
+
+// WithdrawalAmount converts the gwei amount of w to wei.
+func WithdrawalAmount(w *types.Withdrawal) *big.Int {
+	amount := new(big.Int).SetUint64(w.Amount)
+	return amount.Mul(amount, big.NewInt(params.GWei))
+}
+
+func (f *EthFeed) FeedStateDiffs(diffs []*TxStateDiff, blockNumber uint64) []StateDiff {
+	var out []StateDiff
+	for _, diff := range diffs {
+		for _, account := range diff.Accounts {
+			var stateDiff StateDiff
+			stateDiff.BlockIndex = blockNumber
+			stateDiff.TxIndex = diff.TxIndex
+			stateDiff.TxHash = diff.TxHash
+			stateDiff.Address = account.Address.String()
+			stateDiff.BalanceBeforeBig = NewBigInt(account.BalanceBefore)
+			stateDiff.BalanceAfterBig = NewBigInt(account.BalanceAfter)
+			stateDiff.NonceBefore = account.NonceBefore
+			stateDiff.NonceAfter = account.NonceAfter
+			stateDiff.CodeHashBefore = account.CodeHashBefore.String()
+			stateDiff.CodeHashAfter = account.CodeHashAfter.String()
+			stateDiff.Storage = account.Storage
+			stateDiff.Read = account.Read
+
+			out = append(out, stateDiff)
+		}
+	}
+
+	return out
+}
+
 func (f *EthFeed) FeedEvents(receipts types.Receipts) []mamoru_sniffer.Event {
 	var events []mamoru_sniffer.Event
 	for _, receipt := range receipts {
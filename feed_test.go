@@ -0,0 +1,221 @@
+package mamoru
+
+import (
+	"math"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/consensus/beacon"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/stretchr/testify/assert"
+)
+
+// 100 ETH does not fit into uint64 wei.
+var hundredEther = new(big.Int).Mul(big.NewInt(100), big.NewInt(params.Ether))
+
+func signedTx(t *testing.T, value *big.Int) *types.Transaction {
+	key, _ := crypto.GenerateKey()
+	to := common.HexToAddress("0x01")
+	tx, err := types.SignTx(types.NewTransaction(0, to, value, 21000, big.NewInt(params.GWei), nil), types.HomesteadSigner{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestEthFeed_FeedTransactions_Values(t *testing.T) {
+	tx := signedTx(t, hundredEther)
+
+	t.Run("lossless and saturated", func(t *testing.T) {
+		feed := NewFeed(params.TestChainConfig)
+		txs := feed.FeedTransactions(big.NewInt(1), 0, nil, types.Transactions{tx}, nil)
+		assert.Len(t, txs, 1)
+		assert.Equal(t, hundredEther.String(), txs[0].ValueBig.String())
+		assert.Equal(t, uint64(math.MaxUint64), txs[0].Value)
+		assert.Equal(t, hundredEther.Bytes(), new(big.Int).SetBytes(txs[0].ValueBig.Bytes32()).Bytes())
+	})
+	t.Run("legacy wraps", func(t *testing.T) {
+		feed := NewFeed(params.TestChainConfig, WithLegacyValues())
+		txs := feed.FeedTransactions(big.NewInt(1), 0, nil, types.Transactions{tx}, nil)
+		assert.Len(t, txs, 1)
+		assert.Equal(t, hundredEther.Uint64(), txs[0].Value)
+		assert.Equal(t, hundredEther.String(), txs[0].ValueBig.String())
+	})
+}
+
+func TestEthFeed_FeedCallTraces_Values(t *testing.T) {
+	feed := NewFeed(params.TestChainConfig)
+	traces := feed.FeedCallTraces([]*CallFrame{{Type: "CALL", Value: hundredEther}, {Type: "STATICCALL"}}, 1)
+	assert.Len(t, traces, 2)
+	assert.Equal(t, hundredEther.String(), traces[0].ValueBig.String())
+	assert.Equal(t, uint64(math.MaxUint64), traces[0].Value)
+	assert.Nil(t, traces[1].ValueBig)
+	assert.Equal(t, uint64(0), traces[1].Value)
+}
+
+func TestBigInt_Text(t *testing.T) {
+	b := NewBigInt(hundredEther)
+	text, err := b.MarshalText()
+	assert.NoError(t, err)
+	assert.Equal(t, "100000000000000000000", string(text))
+
+	var decoded BigInt
+	assert.NoError(t, decoded.UnmarshalText(text))
+	assert.Equal(t, 0, decoded.Big().Cmp(hundredEther))
+	assert.Error(t, decoded.UnmarshalText([]byte("0x10")))
+}
+
+func TestEthFeed_FeedTransactions_Fees(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	signer := types.LatestSigner(params.TestChainConfig)
+	tx := types.MustSignNewTx(key, signer, &types.DynamicFeeTx{
+		ChainID:   params.TestChainConfig.ChainID,
+		Gas:       100000,
+		GasFeeCap: big.NewInt(30 * params.GWei),
+		GasTipCap: big.NewInt(2 * params.GWei),
+		To:        &common.Address{},
+		Value:     big.NewInt(1),
+	})
+	baseFee := big.NewInt(10 * params.GWei)
+	receipt := &types.Receipt{Status: types.ReceiptStatusSuccessful, GasUsed: 21000}
+
+	feed := NewFeed(params.TestChainConfig)
+	txs := feed.FeedTransactions(big.NewInt(1), 0, baseFee, types.Transactions{tx}, types.Receipts{receipt})
+	assert.Len(t, txs, 1)
+
+	got := txs[0]
+	assert.Equal(t, uint64(21000), got.GasUsed)
+	assert.Equal(t, uint64(12*params.GWei), got.GasPrice)
+	assert.Equal(t, uint64(21000*12*params.GWei), got.Fee)
+	assert.Equal(t, uint64(21000*2*params.GWei), got.PriorityFeeBig.Big().Uint64())
+	assert.Equal(t, uint64(21000*10*params.GWei), got.BurntFeeBig.Big().Uint64())
+	assert.Equal(t, uint64(30*params.GWei), got.GasFeeCapBig.Big().Uint64())
+
+	t.Run("fee cap below base fee plus tip", func(t *testing.T) {
+		txs := feed.FeedTransactions(big.NewInt(1), 0, big.NewInt(29*params.GWei), types.Transactions{tx}, types.Receipts{receipt})
+		assert.Equal(t, uint64(30*params.GWei), txs[0].GasPrice)
+		assert.Equal(t, uint64(21000*params.GWei), txs[0].PriorityFeeBig.Big().Uint64())
+	})
+	t.Run("no receipt", func(t *testing.T) {
+		txs := feed.FeedTransactions(big.NewInt(1), 0, baseFee, types.Transactions{tx}, nil)
+		assert.Equal(t, uint64(0), txs[0].GasUsed)
+		assert.Nil(t, txs[0].FeeBig)
+	})
+}
+
+type testChainReader struct {
+	engine consensus.Engine
+	td     *big.Int
+}
+
+func (c *testChainReader) Engine() consensus.Engine { return c.engine }
+
+func (c *testChainReader) GetTd(common.Hash, uint64) *big.Int { return c.td }
+
+func TestEthFeed_FeedBlock(t *testing.T) {
+	coinbase := common.HexToAddress("0xc0ffee")
+	key, _ := crypto.GenerateKey()
+	signer := types.LatestSigner(params.TestChainConfig)
+	tx := types.MustSignNewTx(key, signer, &types.DynamicFeeTx{
+		ChainID:   params.TestChainConfig.ChainID,
+		Gas:       21000,
+		GasFeeCap: big.NewInt(30 * params.GWei),
+		GasTipCap: big.NewInt(2 * params.GWei),
+		To:        &common.Address{},
+	})
+	receipts := types.Receipts{{Status: types.ReceiptStatusSuccessful, GasUsed: 21000}}
+	tips := big.NewInt(21000 * 2 * params.GWei)
+
+	newBlock := func(difficulty int64, uncles []*types.Header) *types.Block {
+		header := &types.Header{
+			Number:     big.NewInt(100),
+			Coinbase:   coinbase,
+			Difficulty: big.NewInt(difficulty),
+			BaseFee:    big.NewInt(10 * params.GWei),
+			MixDigest:  common.HexToHash("0x01"),
+			Extra:      []byte("extra"),
+		}
+		return types.NewBlock(header, types.Transactions{tx}, uncles, receipts, trie.NewStackTrie(nil))
+	}
+
+	t.Run("ethash", func(t *testing.T) {
+		td, _ := new(big.Int).SetString("58750003716598352816469", 10)
+		feed := NewFeed(params.TestChainConfig, WithChain(&testChainReader{engine: ethash.NewFaker(), td: td}))
+		block := newBlock(1000, []*types.Header{{Number: big.NewInt(99), Difficulty: big.NewInt(1)}})
+		got := feed.FeedBlock(block, receipts)
+
+		static := new(big.Int).Add(ethash.ConstantinopleBlockReward, new(big.Int).Div(ethash.ConstantinopleBlockReward, big.NewInt(32)))
+		assert.Equal(t, coinbase.String(), got.FeeRecipient)
+		assert.Equal(t, td.String(), got.TotalDifficultyBig.String())
+		assert.Equal(t, uint64(math.MaxUint64), got.TotalDifficulty)
+		assert.False(t, got.PostMerge)
+		assert.Equal(t, static.String(), got.StaticRewardBig.String())
+		assert.Equal(t, tips.String(), got.PriorityFeesBig.String())
+		assert.Equal(t, new(big.Int).Add(static, tips).Bytes(), got.BlockReward)
+		assert.Equal(t, uint32(1), got.TxCount)
+		assert.Equal(t, uint32(1), got.UncleCount)
+		assert.Equal(t, "10000000000", got.BaseFeeBig.String())
+		assert.Equal(t, []byte("extra"), got.ExtraData)
+		assert.Equal(t, common.HexToHash("0x01").String(), got.MixDigest)
+	})
+	t.Run("beacon", func(t *testing.T) {
+		config := *params.TestChainConfig
+		config.TerminalTotalDifficulty = big.NewInt(0)
+		feed := NewFeed(&config, WithChain(&testChainReader{engine: beacon.NewFaker()}))
+		got := feed.FeedBlock(newBlock(0, nil), receipts)
+
+		assert.True(t, got.PostMerge)
+		assert.Nil(t, got.TotalDifficultyBig)
+		assert.Equal(t, "0", got.StaticRewardBig.String())
+		assert.Equal(t, tips.String(), got.BlockRewardBig.String())
+	})
+	t.Run("clique", func(t *testing.T) {
+		config := *params.TestChainConfig
+		config.Ethash = nil
+		config.Clique = &params.CliqueConfig{Period: 1, Epoch: 30000}
+		feed := NewFeed(&config)
+		got := feed.FeedBlock(newBlock(2, nil), receipts)
+
+		assert.Equal(t, "0", got.StaticRewardBig.String())
+		assert.Equal(t, tips.String(), got.BlockRewardBig.String())
+	})
+}
+
+func TestEthFeed_FeedWithdrawals(t *testing.T) {
+	addr := common.HexToAddress("0xbeef")
+	feed := NewFeed(params.TestChainConfig)
+	withdrawals := feed.FeedWithdrawals(types.Withdrawals{
+		{Index: 7, Validator: 42, Address: addr, Amount: 32 * params.GWei},
+		{Index: 8, Validator: 43, Address: addr, Amount: params.GWei},
+	}, 100)
+	assert.Len(t, withdrawals, 2)
+
+	w := withdrawals[0]
+	assert.Equal(t, uint64(7), w.Index)
+	assert.Equal(t, uint64(42), w.ValidatorIndex)
+	assert.Equal(t, uint64(100), w.BlockIndex)
+	assert.Equal(t, addr.String(), w.Address)
+	assert.Equal(t, uint64(32*params.GWei), w.Amount)
+	assert.Equal(t, "32000000000000000000", w.AmountBig.String())
+
+	traces := wireWithdrawals(withdrawals)
+	assert.Len(t, traces, 2)
+	assert.Equal(t, CallTypeWithdrawal, traces[0].Type)
+	assert.Equal(t, uint32(WithdrawalTxIndex), traces[0].TxIndex)
+	assert.Equal(t, addr.String(), traces[0].To)
+	// In wei as the other call traces, a full exit saturates
+	assert.Equal(t, uint64(math.MaxUint64), traces[0].Value)
+	assert.Equal(t, uint64(params.Ether), traces[1].Value)
+
+	// Legacy values wrap around
+	withdrawals = NewFeed(params.TestChainConfig, WithLegacyValues()).FeedWithdrawals(types.Withdrawals{
+		{Address: addr, Amount: 32 * params.GWei},
+	}, 100)
+	assert.Equal(t, new(big.Int).Mul(big.NewInt(32), big.NewInt(params.Ether)).Uint64(), wireWithdrawals(withdrawals)[0].Value)
+}
@@ -8,8 +8,10 @@ import (
 )
 
 type Feeder interface {
-	FeedBlock(*types.Block) mamoru_sniffer.Block
-	FeedTransactions(blockNumber *big.Int, blockTime uint64, txs types.Transactions, receipts types.Receipts) []mamoru_sniffer.Transaction
+	FeedBlock(*types.Block, types.Receipts) Block
+	FeedTransactions(blockNumber *big.Int, blockTime uint64, baseFee *big.Int, txs types.Transactions, receipts types.Receipts) []Transaction
 	FeedEvents(types.Receipts) []mamoru_sniffer.Event
-	FeedCallTraces([]*CallFrame, uint64) []mamoru_sniffer.CallTrace
+	FeedCallTraces([]*CallFrame, uint64) []CallTrace
+	FeedWithdrawals(types.Withdrawals, uint64) []Withdrawal
+	FeedStateDiffs([]*TxStateDiff, uint64) []StateDiff
 }
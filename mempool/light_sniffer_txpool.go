@@ -2,6 +2,8 @@ package mempool
 
 import (
 	"context"
+	"math/big"
+	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -13,6 +15,7 @@ import (
 	"github.com/ethereum/go-ethereum/params"
 
 	mamoru "github.com/Mamoru-Foundation/geth-mamoru-core-sdk"
+	"github.com/Mamoru-Foundation/geth-mamoru-core-sdk/backfill"
 	"github.com/Mamoru-Foundation/geth-mamoru-core-sdk/call_tracer"
 )
 
@@ -20,6 +23,7 @@ type lightBlockChain interface {
 	core.ChainContext
 
 	GetBlockByHash(context.Context, common.Hash) (*types.Block, error)
+	GetTd(hash common.Hash, number uint64) *big.Int
 	CurrentHeader() *types.Header
 	Odr() light.OdrBackend
 
@@ -38,11 +42,27 @@ type LightSnifferBackend struct {
 	headSub event.Subscription
 
 	ctx context.Context
-
-	sniffer *mamoru.Sniffer
+	mu  sync.RWMutex
+
+	sniffer       *mamoru.Sniffer
+	errorRegistry mamoru.ErrorRegistry
+	withStorage   bool
+	traceOptions  call_tracer.Options
+	tracePool     *call_tracer.Pool
+	workers       int
+	verify        bool
+	catchUp       *backfill.Tracker
+	reorgs        *backfill.ReorgHandler
+	lastHead      *types.Header
+	confirmer     *mamoru.Confirmer
 }
 
-func NewLightSniffer(ctx context.Context, txPool TxPool, chain lightBlockChain, chainConfig *params.ChainConfig) *LightSnifferBackend {
+// NewLightSniffer returns the txpool sniffer of a light node. Without
+// options, it is configured by the environment variables, see
+// mamoru.WithConfig.
+func NewLightSniffer(ctx context.Context, txPool TxPool, chain lightBlockChain, chainConfig *params.ChainConfig,
+	opts ...mamoru.SnifferOption,
+) *LightSnifferBackend {
 	sb := &LightSnifferBackend{
 		txPool:       txPool,
 		chain:        chain,
@@ -52,8 +72,24 @@ func NewLightSniffer(ctx context.Context, txPool TxPool, chain lightBlockChain,
 
 		ctx: ctx,
 
-		sniffer: mamoru.NewSniffer(),
+		sniffer:      mamoru.NewSniffer(opts...),
+		traceOptions: call_tracer.Options{ContinueOnError: true, Cache: call_tracer.SharedCache},
+	}
+	workers := 0
+	if cfg := sb.sniffer.Config(); cfg != nil {
+		sb.traceOptions.TxTimeout = time.Duration(cfg.Tracer.TxTimeout)
+		sb.traceOptions.BlockDeadline = time.Duration(cfg.Tracer.BlockDeadline)
+		sb.traceOptions.ContinueOnError = cfg.Tracer.ContinueOnError
+		sb.withStorage = cfg.Tracer.WithStorage
+		sb.verify = cfg.Tracer.Verify
+		workers = cfg.Tracer.Workers
 	}
+	pool, err := call_tracer.NewPool(workers)
+	if err != nil {
+		log.Error("Mamoru trace pool", "err", err, "ctx", mamoru.CtxLightTxpool)
+	}
+	sb.tracePool, sb.workers = pool, workers
+
 	sb.headSub = sb.SubscribeChainHeadEvent(sb.newHeadEvent)
 	sb.TxSub = sb.SubscribeNewTxsEvent(sb.newTxsEvent)
 
@@ -62,6 +98,65 @@ func NewLightSniffer(ctx context.Context, txPool TxPool, chain lightBlockChain,
 	return sb
 }
 
+// SetErrorRegistry sets the registry custom errors in revert payloads are
+// decoded with.
+func (bc *LightSnifferBackend) SetErrorRegistry(registry mamoru.ErrorRegistry) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.errorRegistry = registry
+}
+
+// SetStorageTracking makes the traced call frames record their SLOAD and
+// SSTORE.
+func (bc *LightSnifferBackend) SetStorageTracking(enabled bool) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.withStorage = enabled
+}
+
+// SetTraceOptions sets the timeouts and the worker pool blocks are traced
+// with. Without a pool in opts, the pool of the backend is used. By default
+// the backend traces with ContinueOnError and call_tracer.SharedCache, which
+// the light chain shares.
+func (bc *LightSnifferBackend) SetTraceOptions(opts call_tracer.Options) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.traceOptions = opts
+}
+
+// SetVerification enables the check of every traced block against its
+// header. A block that diverges is still sent, marked as diverged.
+func (bc *LightSnifferBackend) SetVerification(enabled bool) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.verify = enabled
+}
+
+// SetCatchUp makes the backend send the blocks missed before each head with
+// tracker, and record the heads it delivers.
+func (bc *LightSnifferBackend) SetCatchUp(tracker *backfill.Tracker) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.catchUp = tracker
+}
+
+// SetReorgHandler makes the backend send the reorgs between the heads it
+// processes with handler: a retraction notice for each dropped block, then
+// the added ones. The new head is sent tagged with the depth of the reorg.
+func (bc *LightSnifferBackend) SetReorgHandler(handler *backfill.ReorgHandler) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.reorgs = handler
+}
+
+// SetConfirmer makes the backend hold the blocks back with confirmer until
+// they are confirmed.
+func (bc *LightSnifferBackend) SetConfirmer(confirmer *mamoru.Confirmer) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.confirmer = confirmer
+}
+
 func (bc *LightSnifferBackend) SubscribeNewTxsEvent(ch chan<- core.NewTxsEvent) event.Subscription {
 	return bc.txPool.SubscribeNewTxsEvent(ch)
 }
@@ -77,12 +172,19 @@ func (bc *LightSnifferBackend) SnifferLoop() {
 	defer func() {
 		bc.headSub.Unsubscribe()
 		bc.TxSub.Unsubscribe()
+		if bc.tracePool != nil {
+			bc.tracePool.Close()
+		}
 	}()
 
 	for {
 		select {
 		case <-bc.ctx.Done():
+			cancel()
+			return
 		case <-bc.headSub.Err():
+			cancel()
+			return
 		case <-bc.TxSub.Err():
 			cancel()
 			return
@@ -96,7 +198,56 @@ func (bc *LightSnifferBackend) SnifferLoop() {
 }
 
 func (bc *LightSnifferBackend) processHead(ctx context.Context, head *types.Header) {
-	if ctx.Err() != nil || !bc.sniffer.CheckRequirements() {
+	if ctx.Err() != nil || !bc.sniffer.CheckRequirements() || !bc.sniffer.ContextEnabled(mamoru.CtxLightTxpool) {
+		return
+	}
+
+	// Read once, a reconfiguration applies from the next block
+	cfg, override := bc.sniffer.BlockConfig(mamoru.CtxLightTxpool), bc.sniffer.Controller().PipelineConfig(mamoru.CtxLightTxpool)
+
+	bc.mu.Lock()
+	catchUp, reorgs, lastHead, confirmer := bc.catchUp, bc.reorgs, bc.lastHead, bc.confirmer
+	bc.lastHead = head
+	bc.mu.Unlock()
+
+	var reorgDepth uint64
+	if reorgs != nil && lastHead != nil && head.ParentHash != lastHead.Hash() {
+		reorg, err := reorgs.Submit(lastHead, head)
+		if err != nil {
+			log.Error("Mamoru reorg", "number", head.Number.Uint64(), "err", err, "ctx", mamoru.CtxLightTxpool)
+		}
+		if reorg != nil {
+			reorgDepth = reorg.Depth()
+		}
+	}
+
+	// The head counts as delivered once the sink took it, a head the
+	// confirmer holds once it is sent
+	var (
+		delivered bool
+		held      bool
+	)
+	done := func(ok bool) {
+		if catchUp == nil {
+			return
+		}
+		if err := catchUp.Done(head, ok); err != nil {
+			log.Error("Mamoru catch-up", "number", head.Number.Uint64(), "err", err, "ctx", mamoru.CtxLightTxpool)
+		}
+	}
+	if catchUp != nil {
+		catchUp.CatchUp(ctx, head)
+	}
+	defer func() {
+		if !held {
+			done(delivered)
+		}
+	}()
+
+	// Sent by the light chain already
+	if reorgDepth == 0 && mamoru.DefaultDeliveries.Delivered(head.Hash(), mamoru.CtxLightTxpool) {
+		log.Info("Mamoru LightTxPool Sniffer skip delivered", "number", head.Number.Uint64(), "ctx", mamoru.CtxLightTxpool)
+		delivered = mamoru.DefaultDeliveries.Acknowledged(head.Hash(), mamoru.CtxLightTxpool)
 		return
 	}
 
@@ -104,9 +255,13 @@ func (bc *LightSnifferBackend) processHead(ctx context.Context, head *types.Head
 	startTime := time.Now()
 
 	// Create tracer context
-	tracer := mamoru.NewTracer(mamoru.NewFeed(bc.chainConfig))
+	tracer := mamoru.NewTracer(mamoru.NewFeed(bc.chainConfig, mamoru.WithChain(bc.chain)), mamoru.WithTracerConfig(cfg))
+	tracer.SetSink(bc.sniffer.Sink())
 	// Set tracer context Txpool
 	tracer.SetTxpoolCtx()
+	if reorgDepth > 0 {
+		tracer.SetReorgDepth(reorgDepth)
+	}
 
 	parentBlock, err := bc.chain.GetBlockByHash(ctx, head.ParentHash)
 	if err != nil {
@@ -121,28 +276,75 @@ func (bc *LightSnifferBackend) processHead(ctx context.Context, head *types.Head
 		log.Error("Mamoru current block", "number", head.Number.Uint64(), "err", err, "ctx", mamoru.CtxLightTxpool)
 		return
 	}
-	tracer.FeedBlock(newBlock)
+	receipts, err := light.GetBlockReceipts(ctx, bc.chain.Odr(), newBlock.Hash(), newBlock.NumberU64())
+	if err != nil {
+		log.Error("Mamoru block receipt", "number", head.Number.Uint64(), "err", err, "ctx", mamoru.CtxLightTxpool)
+		return
+	}
 
-	callFrames, err := call_tracer.TraceBlock(ctx, call_tracer.NewTracerConfig(stateDb.Copy(), bc.chainConfig, bc.chain), newBlock)
+	bc.mu.RLock()
+	traceOptions := bc.traceOptions
+	if traceOptions.Pool == nil {
+		traceOptions.Pool = bc.tracePool
+	}
+	withStorage, verify, workers := bc.withStorage, bc.verify, bc.workers
+	if override != nil {
+		traceOptions.TxTimeout = time.Duration(override.Tracer.TxTimeout)
+		traceOptions.BlockDeadline = time.Duration(override.Tracer.BlockDeadline)
+		traceOptions.ContinueOnError = override.Tracer.ContinueOnError
+		withStorage, verify, workers = override.Tracer.WithStorage, override.Tracer.Verify, override.Tracer.Workers
+	}
+	if bc.tracePool != nil && traceOptions.Pool == bc.tracePool {
+		bc.tracePool.Tune(workers)
+	}
+	if verify {
+		onDivergence := traceOptions.OnDivergence
+		traceOptions.OnDivergence = func(divergence *call_tracer.Divergence) {
+			log.Warn("Mamoru block diverges", "number", divergence.BlockNumber, "hash", divergence.BlockHash,
+				"tx", divergence.TxIndex, "reason", divergence.Reason, "ctx", mamoru.CtxLightTxpool)
+			tracer.MarkDiverged(divergence.String())
+			if onDivergence != nil {
+				onDivergence(divergence)
+			}
+		}
+	}
+	traceConfig := call_tracer.NewTracerConfig(stateDb.Copy(), bc.chainConfig, bc.chain).
+		WithErrorRegistry(bc.errorRegistry).
+		WithStorage(withStorage).
+		WithOptions(traceOptions).
+		WithReceipts(receipts)
+	bc.mu.RUnlock()
+
+	// A block that can't be traced is still sent, without call traces
+	callFrames, err := call_tracer.TraceBlock(ctx, traceConfig, newBlock)
 	if err != nil {
 		log.Error("Mamoru block trace", "number", head.Number.Uint64(), "err", err, "ctx", mamoru.CtxLightTxpool)
-		return
+		tracer.MarkIncomplete(err.Error())
+	}
+	for _, txErr := range call_tracer.TraceErrors(callFrames) {
+		tracer.MarkIncomplete(txErr.Error())
 	}
 
 	for _, call := range callFrames {
 		result := call.Result
 		tracer.FeedCalTraces(result, head.Number.Uint64())
+		if call.StateDiff != nil {
+			tracer.FeedStateDiffs([]*mamoru.TxStateDiff{call.StateDiff}, head.Number.Uint64())
+		}
 	}
 
-	receipts, err := light.GetBlockReceipts(ctx, bc.chain.Odr(), newBlock.Hash(), newBlock.NumberU64())
-	if err != nil {
-		log.Error("Mamoru block receipt", "number", head.Number.Uint64(), "err", err, "ctx", mamoru.CtxLightTxpool)
-		return
-	}
-
-	tracer.FeedTransactions(newBlock.Number(), newBlock.Time(), newBlock.Transactions(), receipts)
+	tracer.FeedBlock(newBlock, receipts)
+	tracer.FeedTransactions(newBlock.Number(), newBlock.Time(), newBlock.BaseFee(), newBlock.Transactions(), receipts)
 	tracer.FeedEvents(receipts)
+	tracer.FeedWithdrawals(newBlock.Withdrawals(), newBlock.NumberU64())
 
 	// finish tracer context
-	tracer.Send(startTime, newBlock.Number(), newBlock.Hash(), mamoru.CtxLightTxpool)
+	if confirmer != nil {
+		held = true
+		confirmer.SendThen(tracer, startTime, newBlock.Number(), newBlock.Hash(), mamoru.CtxLightTxpool, func(err error) {
+			done(err == nil)
+		})
+		return
+	}
+	delivered = tracer.Send(startTime, newBlock.Number(), newBlock.Hash(), mamoru.CtxLightTxpool) == nil
 }
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	mamoru "github.com/Mamoru-Foundation/geth-mamoru-core-sdk"
+	"github.com/Mamoru-Foundation/geth-mamoru-core-sdk/backfill"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/state"
@@ -28,6 +29,7 @@ type blockChain interface {
 
 	SubscribeChainHeadEvent(ch chan<- core.ChainHeadEvent) event.Subscription
 	SubscribeChainEvent(ch chan<- core.ChainEvent) event.Subscription
+	SubscribeChainSideEvent(ch chan<- core.ChainSideEvent) event.Subscription
 }
 
 type SnifferBackend struct {
@@ -39,20 +41,29 @@ type SnifferBackend struct {
 	newHeadEvent chan core.ChainHeadEvent
 	newTxsEvent  chan core.NewTxsEvent
 
-	chEv chan core.ChainEvent
+	chEv   chan core.ChainEvent
+	sideEv chan core.ChainSideEvent
 
 	TxSub   event.Subscription
 	headSub event.Subscription
 
-	chEvSub event.Subscription
+	chEvSub   event.Subscription
+	sideEvSub event.Subscription
 
 	ctx context.Context
 	mu  sync.RWMutex
 
-	sniffer *mamoru.Sniffer
+	sniffer       *mamoru.Sniffer
+	errorRegistry mamoru.ErrorRegistry
+	withStorage   bool
+	reorgs        *backfill.ReorgHandler
 }
 
-func NewSniffer(ctx context.Context, txPool TxPool, chain blockChain, chainConfig *params.ChainConfig, feeder mamoru.Feeder) *SnifferBackend {
+// NewSniffer returns the txpool sniffer of a full node. Without options, it
+// is configured by the environment variables, see mamoru.WithConfig.
+func NewSniffer(ctx context.Context, txPool TxPool, chain blockChain, chainConfig *params.ChainConfig, feeder mamoru.Feeder,
+	opts ...mamoru.SnifferOption,
+) *SnifferBackend {
 	sb := &SnifferBackend{
 		txPool:      txPool,
 		chain:       chain,
@@ -61,22 +72,51 @@ func NewSniffer(ctx context.Context, txPool TxPool, chain blockChain, chainConfi
 		newTxsEvent:  make(chan core.NewTxsEvent, txpool.DefaultConfig.GlobalQueue),
 		newHeadEvent: make(chan core.ChainHeadEvent, 10),
 
-		chEv: make(chan core.ChainEvent, 10),
+		chEv:   make(chan core.ChainEvent, 10),
+		sideEv: make(chan core.ChainSideEvent, 10),
 
 		feeder: feeder,
 
 		ctx: ctx,
 		mu:  sync.RWMutex{},
 
-		sniffer: mamoru.NewSniffer(),
+		sniffer: mamoru.NewSniffer(opts...),
+	}
+	if cfg := sb.sniffer.Config(); cfg != nil {
+		sb.withStorage = cfg.Tracer.WithStorage
 	}
 	sb.TxSub = sb.SubscribeNewTxsEvent(sb.newTxsEvent)
 	sb.headSub = sb.SubscribeChainHeadEvent(sb.newHeadEvent)
 	sb.chEvSub = sb.SubscribeChainEvent(sb.chEv)
+	sb.sideEvSub = sb.SubscribeChainSideEvent(sb.sideEv)
 
 	return sb
 }
 
+// SetErrorRegistry sets the registry custom errors in revert payloads are
+// decoded with.
+func (bc *SnifferBackend) SetErrorRegistry(registry mamoru.ErrorRegistry) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.errorRegistry = registry
+}
+
+// SetStorageTracking makes the traced call frames record their SLOAD and
+// SSTORE.
+func (bc *SnifferBackend) SetStorageTracking(enabled bool) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.withStorage = enabled
+}
+
+// SetReorgHandler makes the backend send the reorgs of the chain with
+// handler: a retraction notice for each dropped block, then the added ones.
+func (bc *SnifferBackend) SetReorgHandler(handler *backfill.ReorgHandler) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.reorgs = handler
+}
+
 func (bc *SnifferBackend) SubscribeNewTxsEvent(ch chan<- core.NewTxsEvent) event.Subscription {
 	return bc.txPool.SubscribeNewTxsEvent(ch)
 }
@@ -90,11 +130,17 @@ func (bc *SnifferBackend) SubscribeChainEvent(ch chan<- core.ChainEvent) event.S
 	return bc.chain.SubscribeChainEvent(ch)
 }
 
+// SubscribeChainSideEvent registers a subscription of ChainSideEvent.
+func (bc *SnifferBackend) SubscribeChainSideEvent(ch chan<- core.ChainSideEvent) event.Subscription {
+	return bc.chain.SubscribeChainSideEvent(ch)
+}
+
 func (bc *SnifferBackend) SnifferLoop() {
 	defer func() {
 		bc.TxSub.Unsubscribe()
 		bc.headSub.Unsubscribe()
 		bc.chEvSub.Unsubscribe()
+		bc.sideEvSub.Unsubscribe()
 	}()
 
 	ctx, cancel := context.WithCancel(bc.ctx)
@@ -103,44 +149,76 @@ func (bc *SnifferBackend) SnifferLoop() {
 	for {
 		select {
 		case <-bc.ctx.Done():
+			cancel()
+			return
 		case <-bc.TxSub.Err():
+			cancel()
+			return
 		case <-bc.headSub.Err():
+			cancel()
+			return
 		case <-bc.chEvSub.Err():
 			cancel()
 			return
+		case <-bc.sideEvSub.Err():
+			cancel()
+			return
 
 		case newTx := <-bc.newTxsEvent:
 			bc.process(ctx, header, newTx.Txs)
 
+		// The head may move to a lower or same height block on a reorg
 		case newHead := <-bc.newHeadEvent:
-			if newHead.Block != nil && newHead.Block.NumberU64() > header.Number.Uint64() {
+			if newHead.Block != nil && newHead.Block.Hash() != header.Hash() {
 				log.Info("New core.ChainHeadEvent", "number", newHead.Block.NumberU64(), "ctx", mamoru.CtxTxpool)
-				bc.mu.RLock()
-				header = newHead.Block.Header()
-				bc.mu.RUnlock()
+				header = bc.setHead(header, newHead.Block.Header())
+			}
+
+		// A block left the canonical chain, the head event may come later
+		case <-bc.sideEv:
+			if current := bc.chain.CurrentBlock(); current.Hash() != header.Hash() {
+				log.Info("New core.ChainSideEvent", "number", current.Number.Uint64(), "ctx", mamoru.CtxTxpool)
+				header = bc.setHead(header, current)
 			}
 
 		case newChEv := <-bc.chEv:
 			if newChEv.Block != nil && newChEv.Block.NumberU64() > header.Number.Uint64() {
 				log.Info("New core.ChainEvent", "number", newChEv.Block.NumberU64(), "ctx", mamoru.CtxTxpool)
-				bc.mu.RLock()
-				header = newChEv.Block.Header()
-				bc.mu.RUnlock()
+				header = bc.setHead(header, newChEv.Block.Header())
 			}
 		}
 	}
 }
 
+// setHead returns newHeader as the header to apply transactions on, and
+// queues the reorg from header to it, if any, sent in the background in
+// order with the others.
+func (bc *SnifferBackend) setHead(header, newHeader *types.Header) *types.Header {
+	bc.mu.RLock()
+	reorgs := bc.reorgs
+	bc.mu.RUnlock()
+	if reorgs != nil && newHeader.ParentHash != header.Hash() {
+		if _, err := reorgs.Submit(header, newHeader); err != nil {
+			log.Error("Mamoru reorg", "number", newHeader.Number.Uint64(), "err", err, "ctx", mamoru.CtxTxpool)
+		}
+	}
+	return newHeader
+}
+
 func (bc *SnifferBackend) process(ctx context.Context, header *types.Header, txs types.Transactions) {
-	if ctx.Err() != nil || !bc.sniffer.CheckRequirements() {
+	if ctx.Err() != nil || !bc.sniffer.CheckRequirements() || !bc.sniffer.ContextEnabled(mamoru.CtxTxpool) {
 		return
 	}
 
+	// Read once, a reconfiguration applies from the next block
+	cfg, override := bc.sniffer.BlockConfig(mamoru.CtxTxpool), bc.sniffer.Controller().PipelineConfig(mamoru.CtxTxpool)
+
 	log.Info("Mamoru TxPool Sniffer start", "txs", txs.Len(), "number", header.Number.Uint64(), "ctx", mamoru.CtxTxpool)
 	startTime := time.Now()
 
 	// Create tracer context
-	tracer := mamoru.NewTracer(bc.feeder)
+	tracer := mamoru.NewTracer(bc.feeder, mamoru.WithTracerConfig(cfg))
+	tracer.SetSink(bc.sniffer.Sink())
 
 	// Set txpool context
 	tracer.SetTxpoolCtx()
@@ -154,8 +232,16 @@ func (bc *SnifferBackend) process(ctx context.Context, header *types.Header, txs
 
 	stateDb = stateDb.Copy()
 
+	bc.mu.RLock()
+	tracerConfig := mamoru.CallTracerConfig{ErrorRegistry: bc.errorRegistry, WithStorage: bc.withStorage}
+	bc.mu.RUnlock()
+	if override != nil {
+		tracerConfig.WithStorage = override.Tracer.WithStorage
+	}
+
 	for index, tx := range txs {
-		calltracer := mamoru.NewCallTracer(false)
+		calltracer := mamoru.NewCallTracerWithConfig(tracerConfig)
+		stateTracer := mamoru.NewStateDiffTracer()
 
 		chCtx := core.ChainContext(bc.chain)
 		author, _ := types.LatestSigner(bc.chainConfig).Sender(tx)
@@ -182,7 +268,7 @@ func (bc *SnifferBackend) process(ctx context.Context, header *types.Header, txs
 			"gas_used", header.GasUsed, "gas_pool", gasPool.Gas(), "ctx", mamoru.CtxTxpool)
 
 		receipt, err := core.ApplyTransaction(bc.chainConfig, chCtx, &author, gasPool, stateDb, header, tx,
-			gasUsed, vm.Config{Tracer: calltracer, NoBaseFee: true})
+			gasUsed, vm.Config{Tracer: mamoru.NewMuxTracer(calltracer, stateTracer), NoBaseFee: true})
 		if err != nil {
 			log.Error("Mamoru Apply Transaction", "err", err, "number", header.Number.Uint64(),
 				"tx.hash", txHashStr, "ctx", mamoru.CtxTxpool)
@@ -193,7 +279,7 @@ func (bc *SnifferBackend) process(ctx context.Context, header *types.Header, txs
 
 		receipts = append(receipts, receipt)
 
-		callFrames, err := calltracer.TakeResult()
+		callFrames, err := calltracer.TakeBlockResult(txs)
 		if err != nil {
 			log.Error("Mamoru tracer result", "err", err, "number", header.Number.Uint64(),
 				"ctx", mamoru.CtxTxpool)
@@ -208,10 +294,18 @@ func (bc *SnifferBackend) process(ctx context.Context, header *types.Header, txs
 		log.Info("Mamoru finish collected", "number", header.Number.Uint64(), "txs", txs.Len(),
 			"receipts", receipts.Len(), "callFrames", len(callFrames), "callFrames.input.len", bytesLength, "ctx", mamoru.CtxTxpool)
 		tracer.FeedCalTraces(callFrames, header.Number.Uint64())
+
+		stateDiffs, err := stateTracer.TakeBlockResult(txs)
+		if err != nil {
+			log.Error("Mamoru state diff result", "err", err, "number", header.Number.Uint64(),
+				"ctx", mamoru.CtxTxpool)
+			break
+		}
+		tracer.FeedStateDiffs(stateDiffs, header.Number.Uint64())
 	}
 
 	//tracer.FeedBlock(header)
-	tracer.FeedTransactions(header.Number, header.Time, txs, receipts)
+	tracer.FeedTransactions(header.Number, header.Time, header.BaseFee, txs, receipts)
 	tracer.FeedEvents(receipts)
 	tracer.Send(startTime, header.Number, header.Hash(), mamoru.CtxTxpool)
 }
@@ -76,8 +76,10 @@ func (bc *testBlockChain) SubscribeChainEvent(ch chan<- core.ChainEvent) event.S
 
 func (bc *testBlockChain) CurrentBlock() *types.Header {
 	return &types.Header{
-		Number:   big.NewInt(1),
-		GasLimit: atomic.LoadUint64(&bc.gasLimit),
+		Number:     big.NewInt(1),
+		GasLimit:   atomic.LoadUint64(&bc.gasLimit),
+		Difficulty: big.NewInt(1),
+		BaseFee:    big.NewInt(765625000),
 	}
 }
 
@@ -117,18 +119,18 @@ type testFeeder struct {
 	callFrames []*mamoru2.CallFrame
 }
 
-func (f *testFeeder) FeedBlock(block *types.Block) mamoru_sniffer.Block {
+func (f *testFeeder) FeedBlock(block *types.Block, _ types.Receipts) mamoru2.Block {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 	f.block = block
-	return mamoru_sniffer.Block{}
+	return mamoru2.Block{}
 }
 
-func (f *testFeeder) FeedTransactions(_ *big.Int, _ uint64, txs types.Transactions, _ types.Receipts) []mamoru_sniffer.Transaction {
+func (f *testFeeder) FeedTransactions(_ *big.Int, _ uint64, _ *big.Int, txs types.Transactions, _ types.Receipts) []mamoru2.Transaction {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 	f.txs = append(f.txs, txs...)
-	return []mamoru_sniffer.Transaction{}
+	return []mamoru2.Transaction{}
 }
 
 func (f *testFeeder) FeedEvents(receipts types.Receipts) []mamoru_sniffer.Event {
@@ -138,11 +140,19 @@ func (f *testFeeder) FeedEvents(receipts types.Receipts) []mamoru_sniffer.Event
 	return []mamoru_sniffer.Event{}
 }
 
-func (f *testFeeder) FeedCallTraces(callFrames []*mamoru2.CallFrame, _ uint64) []mamoru_sniffer.CallTrace {
+func (f *testFeeder) FeedCallTraces(callFrames []*mamoru2.CallFrame, _ uint64) []mamoru2.CallTrace {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 	f.callFrames = append(f.callFrames, callFrames...)
-	return []mamoru_sniffer.CallTrace{}
+	return []mamoru2.CallTrace{}
+}
+
+func (f *testFeeder) FeedWithdrawals(types.Withdrawals, uint64) []mamoru2.Withdrawal {
+	return []mamoru2.Withdrawal{}
+}
+
+func (f *testFeeder) FeedStateDiffs([]*mamoru2.TxStateDiff, uint64) []mamoru2.StateDiff {
+	return []mamoru2.StateDiff{}
 }
 
 func (f *testFeeder) Txs() types.Transactions {
@@ -200,7 +210,7 @@ func TestMempoolSniffer(t *testing.T) {
 
 	statedb.SetBalance(address, new(big.Int).SetUint64(params.Ether))
 
-	bChain := &testBlockChain{gasLimit: 100000, statedb: statedb, chainHeadFeed: new(event.Feed), chainEventFeed: new(event.Feed), chainSideEventFeed: new(event.Feed), engine: engine}
+	bChain := &testBlockChain{gasLimit: 10000000, statedb: statedb, chainHeadFeed: new(event.Feed), chainEventFeed: new(event.Feed), chainSideEventFeed: new(event.Feed), engine: engine}
 	db := rawdb.NewMemoryDatabase()
 	chainConfig := params.TestChainConfig
 
@@ -0,0 +1,285 @@
+package mamoru
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/ethdb/leveldb"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+const (
+	DefaultOutboxMaxBytes   = 1 << 30 // 1 GiB
+	DefaultOutboxMinBackoff = time.Second
+	DefaultOutboxMaxBackoff = time.Minute
+)
+
+// outboxPrefix prefixes the keys of the queued blocks, followed by their
+// big endian sequence number so they iterate in order.
+var outboxPrefix = []byte("mamoru-outbox-")
+
+// OutboxOptions tune an Outbox, the zero values stand for the defaults.
+type OutboxOptions struct {
+	// MaxBytes caps the disk use of the queue, the oldest blocks are evicted
+	// past it.
+	MaxBytes uint64
+	// MinBackoff and MaxBackoff bound the wait before a failed delivery is
+	// retried, doubling from one to the other.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Outbox is a Sink queueing the blocks on disk, then delivering them in
+// order to another Sink in the background, so the blocks sent while the
+// validation chain is unreachable are not lost. A failed delivery is retried
+// with an exponential backoff, the blocks behind it wait.
+//
+// Taking no connection itself, an Outbox lets Sniffer.CheckRequirements pass
+// while the validation chain is down, the connection is made before each
+// delivery, through the Connection of the Sniffer the Outbox is set on.
+type Outbox struct {
+	db      ethdb.KeyValueStore
+	closeDb bool
+	dest    Sink
+	options OutboxOptions
+
+	mu    sync.Mutex
+	next  uint64 // Sequence number of the next block queued
+	size  uint64
+	count int
+
+	wake chan struct{}
+	quit chan struct{}
+	done chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// OpenOutbox returns an Outbox queueing in a leveldb database at path,
+// closed with the Outbox.
+func OpenOutbox(path string, dest Sink, opts OutboxOptions) (*Outbox, error) {
+	db, err := leveldb.New(path, 16, 16, "mamoru/outbox/", false)
+	if err != nil {
+		return nil, err
+	}
+	outbox, err := NewOutbox(db, dest, opts)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	outbox.closeDb = true
+	return outbox, nil
+}
+
+// NewOutbox returns an Outbox queueing in db, e.g. the database of the node,
+// and delivering to dest. The blocks left in db by a previous run are
+// delivered first.
+func NewOutbox(db ethdb.KeyValueStore, dest Sink, opts OutboxOptions) (*Outbox, error) {
+	if opts.MaxBytes == 0 {
+		opts.MaxBytes = DefaultOutboxMaxBytes
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = DefaultOutboxMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = DefaultOutboxMaxBackoff
+		if opts.MaxBackoff < opts.MinBackoff {
+			opts.MaxBackoff = opts.MinBackoff
+		}
+	}
+	o := &Outbox{
+		db:      db,
+		dest:    dest,
+		options: opts,
+		wake:    make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	it := db.NewIterator(outboxPrefix, nil)
+	for it.Next() {
+		o.size += uint64(len(it.Key()) + len(it.Value()))
+		o.count++
+		o.next = binary.BigEndian.Uint64(it.Key()[len(outboxPrefix):]) + 1
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+	if o.count > 0 {
+		log.Info("Mamoru outbox resume", "blocks", o.count, "size", common.StorageSize(o.size))
+	}
+
+	go o.drain()
+
+	return o, nil
+}
+
+// Send queues the block, evicting the oldest ones past the disk cap. It
+// fails only if the block can't be written.
+func (o *Outbox) Send(ctx *EvmCtx) error {
+	value, err := json.Marshal(ctx)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	key := outboxKey(o.next)
+	if err := o.db.Put(key, value); err != nil {
+		return err
+	}
+	o.next++
+	o.size += uint64(len(key) + len(value))
+	o.count++
+	o.evict()
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Len returns the number of blocks queued.
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.count
+}
+
+// Size returns the disk use of the queue.
+func (o *Outbox) Size() uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.size
+}
+
+// Close stops the deliveries, the blocks left are delivered by the next
+// Outbox on the same database. Calls after the first return its result.
+func (o *Outbox) Close() error {
+	o.closeOnce.Do(func() {
+		close(o.quit)
+		<-o.done
+		if o.closeDb {
+			o.closeErr = o.db.Close()
+		}
+	})
+	return o.closeErr
+}
+
+// evict drops the oldest blocks past the disk cap, but the last one queued.
+// Called with the lock held.
+func (o *Outbox) evict() {
+	if o.size <= o.options.MaxBytes {
+		return
+	}
+	it := o.db.NewIterator(outboxPrefix, nil)
+	defer it.Release()
+	for o.size > o.options.MaxBytes && o.count > 1 && it.Next() {
+		key := common.CopyBytes(it.Key())
+		if err := o.db.Delete(key); err != nil {
+			log.Error("Mamoru outbox evict", "err", err)
+			return
+		}
+		o.size -= uint64(len(key) + len(it.Value()))
+		o.count--
+		log.Warn("Mamoru outbox full, block dropped", "seq", binary.BigEndian.Uint64(key[len(outboxPrefix):]),
+			"size", common.StorageSize(o.size), "max", common.StorageSize(o.options.MaxBytes))
+	}
+}
+
+// drain delivers the queued blocks in order until Close.
+func (o *Outbox) drain() {
+	defer close(o.done)
+
+	backoff := o.options.MinBackoff
+	for {
+		key, value, ok := o.first()
+		if !ok {
+			select {
+			case <-o.quit:
+				return
+			case <-o.wake:
+			}
+			continue
+		}
+		if err := o.deliver(value); err != nil {
+			log.Warn("Mamoru outbox delivery failed", "blocks", o.Len(), "retry", backoff, "err", err)
+			select {
+			case <-o.quit:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > o.options.MaxBackoff {
+				backoff = o.options.MaxBackoff
+			}
+			continue
+		}
+		backoff = o.options.MinBackoff
+		o.remove(key, value)
+	}
+}
+
+// first returns the oldest block queued.
+func (o *Outbox) first() ([]byte, []byte, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	it := o.db.NewIterator(outboxPrefix, nil)
+	defer it.Release()
+	if !it.Next() {
+		return nil, nil, false
+	}
+	return common.CopyBytes(it.Key()), common.CopyBytes(it.Value()), true
+}
+
+// deliver hands a queued block over to the destination, connecting first if
+// it needs to. A block that can't be decoded is dropped.
+func (o *Outbox) deliver(value []byte) error {
+	var ctx EvmCtx
+	if err := json.Unmarshal(value, &ctx); err != nil {
+		log.Error("Mamoru outbox block dropped", "err", err)
+		return nil
+	}
+	if c, ok := o.dest.(connector); ok {
+		if err := c.connect(); err != nil {
+			return err
+		}
+	}
+	return o.dest.Send(&ctx)
+}
+
+func (o *Outbox) bindConnection(conn *Connection) {
+	if b, ok := o.dest.(connectionBinder); ok {
+		b.bindConnection(conn)
+	}
+}
+
+// remove drops a delivered block, unless it was evicted meanwhile.
+func (o *Outbox) remove(key, value []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if ok, err := o.db.Has(key); err != nil || !ok {
+		return
+	}
+	if err := o.db.Delete(key); err != nil {
+		log.Error("Mamoru outbox remove", "err", err)
+		return
+	}
+	o.size -= uint64(len(key) + len(value))
+	o.count--
+}
+
+func outboxKey(seq uint64) []byte {
+	key := make([]byte, len(outboxPrefix)+8)
+	copy(key, outboxPrefix)
+	binary.BigEndian.PutUint64(key[len(outboxPrefix):], seq)
+	return key
+}
@@ -0,0 +1,110 @@
+package mamoru
+
+import (
+	"errors"
+	"math/big"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakySink fails until it is up.
+type flakySink struct {
+	mu      sync.Mutex
+	up      bool
+	numbers []int64
+}
+
+func (s *flakySink) Send(ctx *EvmCtx) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.up {
+		return errors.New("unreachable")
+	}
+	s.numbers = append(s.numbers, ctx.BlockNumber.Int64())
+	return nil
+}
+
+func (s *flakySink) setUp(up bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.up = up
+}
+
+func (s *flakySink) sent() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int64(nil), s.numbers...)
+}
+
+var testOutboxOptions = OutboxOptions{MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+
+func TestOutbox(t *testing.T) {
+	dest := &flakySink{}
+	outbox, err := NewOutbox(memorydb.New(), dest, testOutboxOptions)
+	require.NoError(t, err)
+	defer outbox.Close()
+
+	for i := int64(1); i <= 3; i++ {
+		require.NoError(t, outbox.Send(&EvmCtx{Context: CtxBlockchain, BlockNumber: big.NewInt(i)}))
+	}
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 3, outbox.Len())
+	assert.Empty(t, dest.sent())
+
+	// Delivered in order once reachable
+	dest.setUp(true)
+	require.Eventually(t, func() bool { return outbox.Len() == 0 }, time.Second, time.Millisecond)
+	assert.Equal(t, []int64{1, 2, 3}, dest.sent())
+	assert.Zero(t, outbox.Size())
+}
+
+func TestOutbox_Evict(t *testing.T) {
+	dest := &flakySink{}
+	outbox, err := NewOutbox(memorydb.New(), dest, testOutboxOptions)
+	require.NoError(t, err)
+	defer outbox.Close()
+
+	require.NoError(t, outbox.Send(&EvmCtx{Context: CtxBlockchain, BlockNumber: big.NewInt(1)}))
+	outbox.options.MaxBytes = 2 * outbox.Size()
+	for i := int64(2); i <= 4; i++ {
+		require.NoError(t, outbox.Send(&EvmCtx{Context: CtxBlockchain, BlockNumber: big.NewInt(i)}))
+	}
+	assert.Equal(t, 2, outbox.Len())
+
+	dest.setUp(true)
+	require.Eventually(t, func() bool { return outbox.Len() == 0 }, time.Second, time.Millisecond)
+	assert.Equal(t, []int64{3, 4}, dest.sent())
+}
+
+func TestOutbox_Resume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+	outbox, err := OpenOutbox(path, &flakySink{}, testOutboxOptions)
+	require.NoError(t, err)
+	for i := int64(1); i <= 2; i++ {
+		require.NoError(t, outbox.Send(&EvmCtx{Context: CtxBlockchain, BlockNumber: big.NewInt(i)}))
+	}
+	require.NoError(t, outbox.Close())
+
+	dest := &flakySink{up: true}
+	outbox, err = OpenOutbox(path, dest, testOutboxOptions)
+	require.NoError(t, err)
+	defer outbox.Close()
+	require.NoError(t, outbox.Send(&EvmCtx{Context: CtxBlockchain, BlockNumber: big.NewInt(3)}))
+
+	require.Eventually(t, func() bool { return outbox.Len() == 0 }, time.Second, time.Millisecond)
+	assert.Equal(t, []int64{1, 2, 3}, dest.sent())
+}
+
+func TestOutbox_CloseTwice(t *testing.T) {
+	outbox, err := OpenOutbox(filepath.Join(t.TempDir(), "outbox"), &flakySink{}, testOutboxOptions)
+	require.NoError(t, err)
+	require.NoError(t, outbox.Close())
+	// E.g. by the sink teardown, then by the sniffer
+	assert.NoError(t, outbox.Close())
+}
@@ -0,0 +1,137 @@
+package mamoru
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+var (
+	errorSelector = [4]byte(crypto.Keccak256([]byte("Error(string)"))[:4])
+	panicSelector = [4]byte(crypto.Keccak256([]byte("Panic(uint256)"))[:4])
+)
+
+// panicReasons are the meanings of Solidity panic codes, see
+// https://docs.soliditylang.org/en/latest/control-structures.html#panic-via-assert-and-error-via-require
+var panicReasons = map[uint64]string{
+	0x00: "generic panic",
+	0x01: "assert(false)",
+	0x11: "arithmetic underflow or overflow",
+	0x12: "division or modulo by zero",
+	0x21: "enum overflow",
+	0x22: "invalid encoded storage byte array accessed",
+	0x31: "out-of-bounds array access; popping on an empty array",
+	0x32: "out-of-bounds access of an array or bytesN",
+	0x41: "out of memory",
+	0x51: "uninitialized function",
+}
+
+// Revert is the decoded payload of a reverted call frame.
+type Revert struct {
+	Selector string // 4-byte selector of the payload, empty if it has none
+
+	Reason string // Message of Error(string)
+
+	PanicCode   *big.Int // Code of Panic(uint256)
+	PanicReason string   // Meaning of PanicCode
+
+	ErrorName string   // Name of a custom error known to the ErrorRegistry
+	ErrorSig  string   // Signature of the custom error, e.g. "Unauthorized(address)"
+	ErrorArgs []string // Arguments of the custom error, formatted with %v
+}
+
+// ErrorRegistry resolves Solidity custom errors by their 4-byte selector.
+type ErrorRegistry interface {
+	ErrorByID(selector [4]byte) (*abi.Error, error)
+}
+
+// ABIErrorRegistry is an ErrorRegistry backed by contract ABIs.
+type ABIErrorRegistry struct {
+	mu     sync.RWMutex
+	errors map[[4]byte]abi.Error
+}
+
+var _ ErrorRegistry = &ABIErrorRegistry{}
+
+func NewABIErrorRegistry(abis ...abi.ABI) *ABIErrorRegistry {
+	r := &ABIErrorRegistry{errors: make(map[[4]byte]abi.Error)}
+	for _, contract := range abis {
+		r.Register(contract)
+	}
+	return r
+}
+
+// Register adds the custom errors declared in contract.
+func (r *ABIErrorRegistry) Register(contract abi.ABI) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range contract.Errors {
+		r.errors[[4]byte(e.ID[:4])] = e
+	}
+}
+
+func (r *ABIErrorRegistry) ErrorByID(selector [4]byte) (*abi.Error, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e, ok := r.errors[selector]
+	if !ok {
+		return nil, fmt.Errorf("no error with id: %#x", selector[:])
+	}
+	return &e, nil
+}
+
+// DecodeRevert decodes the return data of a reverted call. Custom errors are
+// looked up in registry, which may be nil. It returns nil for empty data.
+func DecodeRevert(output []byte, registry ErrorRegistry) *Revert {
+	if len(output) == 0 {
+		return nil
+	}
+	revert := new(Revert)
+	if len(output) < 4 {
+		return revert
+	}
+	selector := [4]byte(output[:4])
+	revert.Selector = hexutil.Encode(selector[:])
+
+	switch selector {
+	case errorSelector:
+		if reason, err := abi.UnpackRevert(output); err == nil {
+			revert.Reason = reason
+		}
+	case panicSelector:
+		if len(output) == 4+32 {
+			revert.PanicCode = new(big.Int).SetBytes(output[4:])
+			revert.PanicReason = panicReason(revert.PanicCode)
+		}
+	default:
+		if registry == nil {
+			break
+		}
+		customErr, err := registry.ErrorByID(selector)
+		if err != nil {
+			break
+		}
+		revert.ErrorName = customErr.Name
+		revert.ErrorSig = customErr.Sig
+		if args, err := customErr.Inputs.Unpack(output[4:]); err == nil {
+			for _, arg := range args {
+				revert.ErrorArgs = append(revert.ErrorArgs, fmt.Sprintf("%v", arg))
+			}
+		}
+	}
+
+	return revert
+}
+
+func panicReason(code *big.Int) string {
+	if code.IsUint64() {
+		if reason, ok := panicReasons[code.Uint64()]; ok {
+			return reason
+		}
+	}
+	return fmt.Sprintf("unknown panic code: %#x", code)
+}
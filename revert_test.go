@@ -0,0 +1,131 @@
+package mamoru
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testErrorsABI = `[{"type":"error","name":"Unauthorized","inputs":[{"name":"caller","type":"address"},{"name":"role","type":"uint256"}]}]`
+
+func mustABI(t *testing.T, definition string) abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(definition))
+	require.NoError(t, err)
+	return parsed
+}
+
+func errorPayload(reason string) []byte {
+	typ, _ := abi.NewType("string", "", nil)
+	packed, _ := abi.Arguments{{Type: typ}}.Pack(reason)
+	return append(errorSelector[:], packed...)
+}
+
+func panicPayload(code int64) []byte {
+	return append(panicSelector[:], common.LeftPadBytes(big.NewInt(code).Bytes(), 32)...)
+}
+
+func TestDecodeRevert(t *testing.T) {
+	errorsABI := mustABI(t, testErrorsABI)
+	registry := NewABIErrorRegistry(errorsABI)
+	caller := common.HexToAddress("0xbad")
+	unauthorized := errorsABI.Errors["Unauthorized"]
+	custom, err := unauthorized.Inputs.Pack(caller, big.NewInt(7))
+	require.NoError(t, err)
+	custom = append(unauthorized.ID.Bytes()[:4], custom...)
+
+	tests := []struct {
+		name     string
+		output   []byte
+		registry ErrorRegistry
+		want     *Revert
+	}{
+		{
+			name:   "empty",
+			output: nil,
+			want:   nil,
+		},
+		{
+			name:   "no selector",
+			output: []byte{1, 2},
+			want:   &Revert{},
+		},
+		{
+			name:   "Error(string)",
+			output: errorPayload("not owner"),
+			want:   &Revert{Selector: "0x08c379a0", Reason: "not owner"},
+		},
+		{
+			name:   "Panic(uint256)",
+			output: panicPayload(0x11),
+			want:   &Revert{Selector: "0x4e487b71", PanicCode: big.NewInt(0x11), PanicReason: "arithmetic underflow or overflow"},
+		},
+		{
+			name:   "unknown panic",
+			output: panicPayload(0x99),
+			want:   &Revert{Selector: "0x4e487b71", PanicCode: big.NewInt(0x99), PanicReason: "unknown panic code: 0x99"},
+		},
+		{
+			name:   "custom error without registry",
+			output: custom,
+			want:   &Revert{Selector: hexutil.Encode(custom[:4])},
+		},
+		{
+			name:     "custom error",
+			output:   custom,
+			registry: registry,
+			want: &Revert{
+				Selector:  hexutil.Encode(custom[:4]),
+				ErrorName: "Unauthorized",
+				ErrorSig:  "Unauthorized(address,uint256)",
+				ErrorArgs: []string{caller.String(), "7"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, DecodeRevert(tt.output, tt.registry))
+		})
+	}
+}
+
+func TestCallTracer_Revert(t *testing.T) {
+	env := newCallEnv(t)
+	reverter, top := common.HexToAddress("0xc0"), common.HexToAddress("0xa0")
+	payload := errorPayload("paused")
+	env.statedb.SetCode(reverter, revertCode(payload))
+	env.statedb.SetCode(top, callCode(false, reverter))
+
+	txs := types.Transactions{env.tx(&top, nil, nil), env.tx(&reverter, nil, nil)}
+	tracer := NewCallTracerWithConfig(CallTracerConfig{ErrorRegistry: NewABIErrorRegistry()})
+	env.apply(tracer, txs)
+
+	frames, err := tracer.TakeBlockResult(txs)
+	require.NoError(t, err)
+	require.Len(t, frames, 3)
+	assert.Nil(t, frames[0].Revert)
+	require.NotNil(t, frames[1].Revert)
+	assert.Equal(t, "paused", frames[1].Revert.Reason)
+	require.NotNil(t, frames[2].Revert)
+	assert.Equal(t, "paused", frames[2].Revert.Reason)
+
+	traces := NewFeed(nil).FeedCallTraces(frames, 1)
+	assert.Equal(t, "paused", traces[1].Revert.Reason)
+}
+
+// revertCode returns code that reverts with payload.
+func revertCode(payload []byte) []byte {
+	var code []byte
+	for i, b := range payload {
+		// MSTORE8(i, b)
+		code = append(code, byte(0x60), b, byte(0x61), byte(i>>8), byte(i), 0x53)
+	}
+	// REVERT(0, len(payload))
+	return append(code, 0x61, byte(len(payload)>>8), byte(len(payload)), 0x60, 0, 0xfd)
+}
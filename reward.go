@@ -0,0 +1,98 @@
+package mamoru
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/consensus/beacon"
+	"github.com/ethereum/go-ethereum/consensus/clique"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// posaEngine matches the Parlia-style engines of BSC-like forks, which pay
+// validators through system transactions instead of a static reward.
+type posaEngine interface {
+	consensus.Engine
+	IsSystemTransaction(tx *types.Transaction, header *types.Header) (bool, error)
+}
+
+// blockReward is what the fee recipient earns from a block.
+type blockReward struct {
+	static   *big.Int // consensus issuance, uncle inclusion included
+	priority *big.Int // tips paid by the block's transactions
+}
+
+func (r blockReward) total() *big.Int {
+	return new(big.Int).Add(r.static, r.priority)
+}
+
+// computeBlockReward returns the reward of block under engine. A nil engine
+// is inferred from the chain config and the block header.
+func computeBlockReward(config *params.ChainConfig, engine consensus.Engine, block *types.Block, receipts types.Receipts) blockReward {
+	reward := blockReward{
+		static:   staticBlockReward(config, engine, block),
+		priority: new(big.Int),
+	}
+	posa, isPoSA := engine.(posaEngine)
+	for i, tx := range block.Transactions() {
+		if i >= receipts.Len() {
+			break
+		}
+		if isPoSA {
+			if isSystem, _ := posa.IsSystemTransaction(tx, block.Header()); isSystem {
+				continue
+			}
+		}
+		fees := computeTxFees(tx, block.BaseFee(), receipts[i])
+		reward.priority.Add(reward.priority, fees.priority)
+	}
+
+	return reward
+}
+
+func staticBlockReward(config *params.ChainConfig, engine consensus.Engine, block *types.Block) *big.Int {
+	header := block.Header()
+	if b, ok := engine.(*beacon.Beacon); ok {
+		if b.IsPoSHeader(header) {
+			return new(big.Int)
+		}
+		engine = b.InnerEngine()
+	}
+	switch engine.(type) {
+	case *ethash.Ethash:
+		return ethashBlockReward(config, header, len(block.Uncles()))
+	case *clique.Clique, posaEngine:
+		return new(big.Int)
+	case nil:
+		// Infer the engine from the config, see eth/ethconfig.CreateConsensusEngine.
+		if isPostMerge(config, header) || config.Clique != nil || config.Ethash == nil {
+			return new(big.Int)
+		}
+		return ethashBlockReward(config, header, len(block.Uncles()))
+	default:
+		return new(big.Int)
+	}
+}
+
+// ethashBlockReward mirrors the miner's share in ethash.accumulateRewards.
+func ethashBlockReward(config *params.ChainConfig, header *types.Header, uncles int) *big.Int {
+	base := ethash.FrontierBlockReward
+	if config.IsByzantium(header.Number) {
+		base = ethash.ByzantiumBlockReward
+	}
+	if config.IsConstantinople(header.Number) {
+		base = ethash.ConstantinopleBlockReward
+	}
+	reward := new(big.Int).Set(base)
+	inclusion := new(big.Int).Div(base, big.NewInt(32))
+	reward.Add(reward, inclusion.Mul(inclusion, big.NewInt(int64(uncles))))
+
+	return reward
+}
+
+// isPostMerge reports whether header was produced by the beacon chain.
+func isPostMerge(config *params.ChainConfig, header *types.Header) bool {
+	return config.TerminalTotalDifficulty != nil && header.Difficulty.Sign() == 0
+}
@@ -0,0 +1,213 @@
+package mamoru
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Mamoru-Foundation/mamoru-sniffer-go/mamoru_sniffer"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ErrNotConnected is returned by the validation chain sink before the
+// connection is made, see Sniffer.CheckRequirements.
+var ErrNotConnected = errors.New("not connected to the validation chain")
+
+// EvmCtx is the data of a block a Tracer hands over to its Sink, as produced
+// by its Feeder. The validation chain sink narrows it to the wire structs,
+// the other sinks get it whole, lossless values included.
+type EvmCtx struct {
+	Context     string      `json:"context"`
+	BlockNumber *big.Int    `json:"blockNumber"`
+	BlockHash   common.Hash `json:"blockHash"`
+	Mempool     bool        `json:"mempool,omitempty"` // Sent by a txpool sniffer, see Tracer.SetTxpoolCtx
+
+	Block        *Block                 `json:"block,omitempty"`
+	Transactions []Transaction          `json:"transactions,omitempty"`
+	Events       []mamoru_sniffer.Event `json:"events,omitempty"`
+	CallTraces   []CallTrace            `json:"callTraces,omitempty"`
+	Withdrawals  []Withdrawal           `json:"withdrawals,omitempty"` // Sent as call traces to the validation chain
+	StateDiffs   []StateDiff            `json:"stateDiffs,omitempty"`  // The validation chain has no slot for them
+}
+
+// Sink receives the blocks sent by tracers. A block whose Send fails is not
+// recorded as delivered, see Deliveries.
+type Sink interface {
+	Send(ctx *EvmCtx) error
+}
+
+// connector is a Sink that connects before its first Send, through
+// Sniffer.CheckRequirements.
+type connector interface {
+	connect() error
+}
+
+// connectionBinder is a Sink sending to the validation chain, directly or
+// through other sinks, over the Connection of the Sniffer it is set on.
+type connectionBinder interface {
+	bindConnection(conn *Connection)
+}
+
+type chainSink struct {
+	sniffer *mamoru_sniffer.Sniffer
+	conn    atomic.Pointer[Connection]
+}
+
+// NewChainSink returns the Sink sending blocks to the validation chain
+// through sniffer. A nil sniffer stands for the connection made by
+// Sniffer.CheckRequirements: the sink connects through the Connection of
+// the first Sniffer it is set on, alone or inside a Tee or an Outbox.
+func NewChainSink(sniffer *mamoru_sniffer.Sniffer) Sink {
+	return &chainSink{sniffer: sniffer}
+}
+
+// Send sends the block to the validation chain. The client reports no
+// error, so a send fails if there is no client or if the client panics.
+// Through a Connection, the outcome counts as a probe of the client.
+func (s *chainSink) Send(ctx *EvmCtx) (err error) {
+	client := s.sniffer
+	if client == nil {
+		client = connectedClient()
+		defer func() {
+			s.connection().report(client, err)
+		}()
+	}
+	if client == nil {
+		return ErrNotConnected
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("send to the validation chain: %v", r)
+		}
+	}()
+
+	builder := mamoru_sniffer.NewEvmCtxBuilder()
+	if ctx.Block != nil {
+		builder.SetBlock(ctx.Block.Block)
+	}
+	builder.AppendTxs(wireTransactions(ctx.Transactions))
+	builder.AppendEvents(ctx.Events)
+	builder.AppendCallTraces(wireCallTraces(ctx.CallTraces))
+	builder.AppendCallTraces(wireWithdrawals(ctx.Withdrawals))
+	if ctx.Mempool {
+		builder.SetMempoolSource()
+	}
+	builder.SetBlockData(ctx.BlockNumber.String(), ctx.BlockHash.String())
+	client.ObserveEvmData(builder.Finish())
+
+	return nil
+}
+
+func (s *chainSink) connect() error {
+	if s.sniffer != nil {
+		return nil
+	}
+	return s.connection().Connect()
+}
+
+func (s *chainSink) bindConnection(conn *Connection) {
+	s.conn.CompareAndSwap(nil, conn)
+}
+
+// connection returns the Connection of the Sniffer the sink is set on, the
+// default one before.
+func (s *chainSink) connection() *Connection {
+	if conn := s.conn.Load(); conn != nil {
+		return conn
+	}
+	return defaultConnection
+}
+
+// FileSink writes the blocks to a file, one JSON object per line, e.g. for
+// audits or to run offline.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+}
+
+// NewFileSink returns a FileSink appending to the file at path, created if
+// needed.
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{file: file, w: bufio.NewWriter(file)}, nil
+}
+
+func (s *FileSink) Send(ctx *EvmCtx) error {
+	line, err := json.Marshal(ctx)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+// Close closes the file.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.w.Flush(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+type teeSink []Sink
+
+// Tee returns a Sink sending the blocks to every sink, e.g. to the
+// validation chain and to a FileSink. It fails if any of them fails.
+func Tee(sinks ...Sink) Sink {
+	return teeSink(sinks)
+}
+
+func (t teeSink) Send(ctx *EvmCtx) error {
+	var errs []error
+	for _, sink := range t {
+		if err := sink.Send(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// connect connects the sinks that need it. The tee is ready once any of its
+// sinks is, so that a file is still written while the validation chain is
+// down.
+func (t teeSink) connect() error {
+	var errs []error
+	for _, sink := range t {
+		c, ok := sink.(connector)
+		if !ok {
+			continue
+		}
+		if err := c.connect(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) < len(t) {
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+func (t teeSink) bindConnection(conn *Connection) {
+	for _, sink := range t {
+		if b, ok := sink.(connectionBinder); ok {
+			b.bindConnection(conn)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package mamoru
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Mamoru-Foundation/mamoru-sniffer-go/mamoru_sniffer"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testSink struct {
+	sent []*EvmCtx
+	err  error
+}
+
+func (s *testSink) Send(ctx *EvmCtx) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.sent = append(s.sent, ctx)
+	return nil
+}
+
+func TestTracer_SetSink(t *testing.T) {
+	sink := &testSink{}
+	block := types.NewBlockWithHeader(&types.Header{Number: big.NewInt(7), Difficulty: big.NewInt(1)})
+
+	tracer := NewTracer(NewFeed(params.TestChainConfig))
+	tracer.SetSink(sink)
+	tracer.SetDeliveries(NewDeliveries(0))
+	tracer.SetTxpoolCtx()
+	tracer.SetBackfillCtx()
+	tracer.FeedBlock(block, nil)
+	tracer.Send(time.Now(), block.Number(), block.Hash(), CtxBackfill)
+
+	require.Len(t, sink.sent, 1)
+	ctx := sink.sent[0]
+	assert.Equal(t, CtxBackfill, ctx.Context)
+	assert.Equal(t, block.Hash(), ctx.BlockHash)
+	assert.True(t, ctx.Mempool)
+	require.NotNil(t, ctx.Block)
+	assert.Equal(t, uint64(7), ctx.Block.BlockIndex)
+	assert.Equal(t, BlockStatusBackfill, ctx.Block.Status)
+}
+
+func TestTracer_SendFails(t *testing.T) {
+	deliveries := NewDeliveries(0)
+	sink := &testSink{err: errors.New("unavailable")}
+	hash := common.Hash{0x01}
+
+	tracer := NewTracer(NewFeed(nil))
+	tracer.SetSink(sink)
+	tracer.SetDeliveries(deliveries)
+	assert.ErrorIs(t, tracer.Send(time.Now(), big.NewInt(1), hash, CtxBlockchain), sink.err)
+	assert.False(t, deliveries.Delivered(hash, CtxBlockchain))
+
+	sink.err = nil
+	assert.NoError(t, tracer.Send(time.Now(), big.NewInt(1), hash, CtxBlockchain))
+	assert.Len(t, sink.sent, 1)
+	assert.True(t, deliveries.Delivered(hash, CtxBlockchain))
+	// Delivered already
+	assert.NoError(t, tracer.Send(time.Now(), big.NewInt(1), hash, CtxBlockchain))
+	assert.Len(t, sink.sent, 1)
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocks.jsonl")
+	sink, err := NewFileSink(path)
+	require.NoError(t, err)
+
+	other := &testSink{}
+	tee := Tee(sink, other)
+	for i := int64(1); i <= 2; i++ {
+		require.NoError(t, tee.Send(&EvmCtx{
+			Context:      CtxBlockchain,
+			BlockNumber:  big.NewInt(i),
+			Transactions: []Transaction{{Transaction: mamoru_sniffer.Transaction{TxIndex: uint32(i)}}},
+		}))
+	}
+	require.NoError(t, sink.Close())
+	assert.Len(t, other.sent, 2)
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var numbers []int64
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var ctx EvmCtx
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &ctx))
+		assert.Equal(t, CtxBlockchain, ctx.Context)
+		require.Len(t, ctx.Transactions, 1)
+		numbers = append(numbers, ctx.BlockNumber.Int64())
+	}
+	assert.Equal(t, []int64{1, 2}, numbers)
+}
+
+func TestSniffer_SetSink(t *testing.T) {
+	connect := SnifferConnectFunc
+	defer func() { SnifferConnectFunc = connect }()
+	SnifferConnectFunc = func() (*mamoru_sniffer.Sniffer, error) { return nil, errors.New("offline") }
+
+	s := NewSniffer()
+	assert.False(t, s.connect())
+
+	// A file sink needs no connection, even teed with the validation chain
+	sink := &testSink{}
+	s.SetSink(sink)
+	assert.Same(t, sink, s.Sink())
+	assert.True(t, s.connect())
+	s.SetSink(Tee(sink, NewChainSink(nil)))
+	assert.True(t, s.connect())
+	s.SetSink(Tee(NewChainSink(nil)))
+	assert.False(t, s.connect())
+}
+
+func TestSniffer_SetSink_Connection(t *testing.T) {
+	up, _ := mockConnect(t)
+
+	// The chain sink behind an outbox connects through the sniffer
+	s := NewSniffer()
+	changes := make(chan ConnStateChange, 10)
+	sub := s.Connection().SubscribeStateChange(changes)
+	outbox, err := NewOutbox(memorydb.New(), NewChainSink(nil), OutboxOptions{MinBackoff: time.Hour})
+	require.NoError(t, err)
+	s.SetSink(outbox)
+	require.NoError(t, outbox.Send(&EvmCtx{Context: CtxBlockchain, BlockNumber: big.NewInt(1)}))
+	var states []ConnState
+	assert.Eventually(t, func() bool {
+		states = append(states, drainChanges(changes)...)
+		return len(states) == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []ConnState{ConnConnecting, ConnDisconnected}, states)
+	require.NoError(t, outbox.Close())
+	sub.Unsubscribe()
+
+	// And in a tee
+	*up = true
+	s = NewSniffer()
+	sub = s.Connection().SubscribeStateChange(changes)
+	defer sub.Unsubscribe()
+	s.SetSink(Tee(&testSink{}, NewChainSink(nil)))
+	assert.True(t, s.connect())
+	assert.Equal(t, ConnReady, s.Connection().State())
+	assert.Equal(t, []ConnState{ConnConnecting, ConnReady}, drainChanges(changes))
+}
+
+func TestFileSink_Lossless(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocks.jsonl")
+	sink, err := NewFileSink(path)
+	require.NoError(t, err)
+
+	tracer := NewTracer(NewFeed(params.TestChainConfig))
+	tracer.SetSink(sink)
+	tracer.SetDeliveries(nil)
+	tracer.FeedTransactions(big.NewInt(1), 0, nil, types.Transactions{signedTx(t, hundredEther)}, nil)
+	tracer.FeedCalTraces([]*CallFrame{{Type: "CALL", Value: hundredEther, TxHash: "0x01", TraceAddress: []uint32{0}, Output: "0x02"}}, 1)
+	tracer.Send(time.Now(), big.NewInt(1), common.Hash{0x01}, CtxBlockchain)
+	require.NoError(t, sink.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var ctx EvmCtx
+	require.NoError(t, json.Unmarshal(data, &ctx))
+
+	// Not truncated to the uint64 wire fields
+	require.Len(t, ctx.Transactions, 1)
+	assert.Equal(t, hundredEther.String(), ctx.Transactions[0].ValueBig.String())
+	require.Len(t, ctx.CallTraces, 1)
+	call := ctx.CallTraces[0]
+	assert.Equal(t, hundredEther.String(), call.ValueBig.String())
+	assert.Equal(t, "0x01", call.TxHash)
+	assert.Equal(t, []uint32{0}, call.TraceAddress)
+	assert.Equal(t, "0x02", call.Output)
+}
+
+func TestTracer_FeedBlock_Extras(t *testing.T) {
+	sink := &testSink{}
+	header := &types.Header{
+		Number:     big.NewInt(7),
+		Difficulty: big.NewInt(0),
+		BaseFee:    big.NewInt(params.GWei),
+		MixDigest:  common.Hash{0x0d},
+		Extra:      []byte("extra"),
+	}
+	block := types.NewBlockWithHeader(header)
+
+	tracer := NewTracer(NewFeed(params.TestChainConfig))
+	tracer.SetSink(sink)
+	tracer.SetDeliveries(nil)
+	tracer.FeedBlock(block, nil)
+	tracer.Send(time.Now(), block.Number(), block.Hash(), CtxBlockchain)
+
+	// The header data beyond the wire block reaches the sink
+	require.Len(t, sink.sent, 1)
+	sent := sink.sent[0].Block
+	require.NotNil(t, sent)
+	assert.Equal(t, uint64(7), sent.BlockIndex)
+	assert.Equal(t, big.NewInt(params.GWei), sent.BaseFeeBig.Big())
+	assert.Equal(t, common.Hash{0x0d}.String(), sent.MixDigest)
+	assert.Equal(t, []byte("extra"), sent.ExtraData)
+	assert.Zero(t, sent.TxCount)
+	assert.NotNil(t, sent.BlockRewardBig)
+}
+
+func TestTracer_FeedStateDiffs(t *testing.T) {
+	sink := &testSink{}
+	address := common.Address{0xaa}
+
+	tracer := NewTracer(NewFeed(params.TestChainConfig))
+	tracer.SetSink(sink)
+	tracer.SetDeliveries(nil)
+	tracer.FeedStateDiffs([]*TxStateDiff{{TxIndex: 1, Accounts: []AccountDiff{{
+		Address: address,
+		Read:    []StorageRead{{Slot: common.Hash{0x01}}},
+	}}}}, 7)
+	tracer.Send(time.Now(), big.NewInt(7), common.Hash{0x07}, CtxBlockchain)
+
+	require.Len(t, sink.sent, 1)
+	diffs := sink.sent[0].StateDiffs
+	require.Len(t, diffs, 1)
+	assert.Equal(t, address.String(), diffs[0].Address)
+	assert.Equal(t, uint32(1), diffs[0].TxIndex)
+	assert.Len(t, diffs[0].Read, 1)
+}
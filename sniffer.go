@@ -3,7 +3,6 @@ package mamoru
 import (
 	"os"
 	"strconv"
-	"strings"
 	"sync"
 
 	"github.com/Mamoru-Foundation/mamoru-sniffer-go/mamoru_sniffer"
@@ -13,7 +12,10 @@ import (
 
 var (
 	sniffer            *mamoru_sniffer.Sniffer
+	connectMu          sync.Mutex
 	SnifferConnectFunc = mamoru_sniffer.Connect
+
+	defaultSink = NewChainSink(nil)
 )
 
 const Delta = 10 // min diff between currentBlock and highestBlock
@@ -27,10 +29,115 @@ type Sniffer struct {
 	status statusProgress
 	synced bool
 	delta  int64
+	sink   Sink
+	conn   *Connection
+	config *Config
+	close  func() error
+
+	controller *Controller
+}
+
+// SnifferOption customizes a Sniffer.
+type SnifferOption func(*Sniffer)
+
+// WithConfig configures the sniffer with a copy of cfg, overridden by the
+// environment variables as by LoadConfig, and sends to the sinks of cfg. A
+// config that is invalid or whose sinks fail to open is logged and leaves
+// the sniffer disabled. A nil cfg keeps the environment variables.
+func WithConfig(cfg *Config) SnifferOption {
+	return func(s *Sniffer) {
+		if cfg == nil {
+			return
+		}
+		cfg := *cfg
+		err := cfg.ApplyEnv()
+		if err == nil {
+			err = cfg.Validate()
+		}
+		if err != nil {
+			log.Error("Mamoru Sniffer config invalid, sniffer disabled", "err", err)
+			s.config = &Config{}
+			return
+		}
+		s.config = &cfg
+		s.delta = cfg.SyncDelta
+		sink, closeSink, err := cfg.OpenSink()
+		if err != nil {
+			log.Error("Mamoru Sniffer sink failed to open, sniffer disabled", "err", err)
+			s.config = &Config{}
+			return
+		}
+		s.bind(sink)
+		s.sink, s.close = sink, closeSink
+	}
 }
 
-func NewSniffer() *Sniffer {
-	return &Sniffer{delta: Delta}
+// WithController makes the pipelines of the sniffer follow controller in
+// place of DefaultController.
+func WithController(controller *Controller) SnifferOption {
+	return func(s *Sniffer) {
+		s.controller = controller
+	}
+}
+
+func NewSniffer(opts ...SnifferOption) *Sniffer {
+	s := &Sniffer{delta: Delta}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Config returns the config of the sniffer, nil if it reads the environment
+// variables.
+func (s *Sniffer) Config() *Config {
+	return s.config
+}
+
+// ContextEnabled reports whether the config of the sniffer enables
+// snifferContext, all are without config, and its pipeline is not paused by
+// the controller. It is checked at the start of a block.
+func (s *Sniffer) ContextEnabled(snifferContext string) bool {
+	if s.Controller().Paused(snifferContext) {
+		return false
+	}
+	return s.config == nil || s.config.ContextEnabled(snifferContext)
+}
+
+// Controller returns the controller pausing and reconfiguring the pipelines
+// of the sniffer.
+func (s *Sniffer) Controller() *Controller {
+	if s.controller == nil {
+		return DefaultController
+	}
+	return s.controller
+}
+
+// BlockConfig returns the config a pipeline processes its next block with:
+// the config of the sniffer, with the tracer options and the filters the
+// controller reconfigured the pipeline with, if any. It is nil without
+// either. The pipelines read it once per block, so that a reconfiguration
+// never applies to a block in flight.
+func (s *Sniffer) BlockConfig(snifferContext string) *Config {
+	override := s.Controller().PipelineConfig(snifferContext)
+	if override == nil {
+		return s.config
+	}
+	cfg := DefaultConfig()
+	if s.config != nil {
+		*cfg = *s.config
+	}
+	cfg.Tracer = override.Tracer
+	cfg.Filters = override.Filters
+	return cfg
+}
+
+// Close closes the sinks opened from the config.
+func (s *Sniffer) Close() error {
+	if s.close == nil {
+		return nil
+	}
+	return s.close()
 }
 
 func (s *Sniffer) SetDownloader(downloader statusProgress) {
@@ -39,6 +146,37 @@ func (s *Sniffer) SetDownloader(downloader statusProgress) {
 	s.status = downloader
 }
 
+// SetSink sets the Sink the tracers of the sniffer send blocks to, the
+// validation chain by default. The chain sinks in it connect through the
+// Connection of the sniffer, a sink other than the validation chain needs
+// no connection.
+func (s *Sniffer) SetSink(sink Sink) {
+	s.bind(sink)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sink = sink
+}
+
+// Sink returns the Sink the tracers of the sniffer send blocks to, see
+// Tracer.SetSink.
+func (s *Sniffer) Sink() Sink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sink == nil {
+		s.sink = NewChainSink(nil)
+		s.sink.(connectionBinder).bindConnection(s.connection())
+	}
+	return s.sink
+}
+
+// bind makes the chain sinks in sink connect through the Connection of the
+// sniffer.
+func (s *Sniffer) bind(sink Sink) {
+	if b, ok := sink.(connectionBinder); ok {
+		b.bindConnection(s.Connection())
+	}
+}
+
 func (s *Sniffer) CheckRequirements() bool {
 	return s.isSnifferEnable() && s.connect() && s.checkSynced()
 }
@@ -72,6 +210,9 @@ func (s *Sniffer) checkSynced() bool {
 }
 
 func (s *Sniffer) isSnifferEnable() bool {
+	if s.config != nil {
+		return s.config.Enabled
+	}
 	val, ok := os.LookupEnv("MAMORU_SNIFFER_ENABLE")
 	if !ok {
 		return false
@@ -86,23 +227,24 @@ func (s *Sniffer) isSnifferEnable() bool {
 	return isEnable
 }
 
+// connect makes the connection the sink needs, if any. The validation
+// chain is connected through the Connection of the sniffer.
 func (s *Sniffer) connect() bool {
-	if sniffer != nil {
-		return true
-	}
+	c, ok := s.Sink().(connector)
+	return !ok || c.connect() == nil
+}
+
+// Connection returns the connection to the validation chain, to query its
+// state or subscribe to its changes.
+func (s *Sniffer) Connection() *Connection {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	var err error
-	if sniffer == nil {
-		sniffer, err = SnifferConnectFunc()
-		if err != nil {
-			erst := strings.Replace(err.Error(), "\t", "", -1)
-			erst = strings.Replace(erst, "\n", "", -1)
-			//	erst = strings.Replace(erst, " ", "", -1)
-			log.Error("Mamoru Sniffer connect", "err", erst)
-			return false
-		}
-	}
+	return s.connection()
+}
 
-	return true
+func (s *Sniffer) connection() *Connection {
+	if s.conn == nil {
+		s.conn = NewConnection(ConnOptions{})
+	}
+	return s.conn
 }
@@ -0,0 +1,258 @@
+package mamoru
+
+import (
+	"bytes"
+	"math/big"
+	"sort"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// TxStateDiff is the state a transaction changed.
+type TxStateDiff struct {
+	TxIndex  uint32
+	TxHash   string // Filled in by TakeBlockResult
+	Accounts []AccountDiff
+}
+
+// AccountDiff is the change of a single account. Unchanged fields have equal
+// before and after values.
+type AccountDiff struct {
+	Address        common.Address
+	BalanceBefore  *big.Int
+	BalanceAfter   *big.Int
+	NonceBefore    uint64
+	NonceAfter     uint64
+	CodeHashBefore common.Hash
+	CodeHashAfter  common.Hash
+	Storage        []StorageDiff // Written slots whose value changed
+	Read           []StorageRead // Slots read and left unchanged
+}
+
+// StorageDiff is the change of a single storage slot.
+type StorageDiff struct {
+	Slot   common.Hash
+	Before common.Hash
+	After  common.Hash
+}
+
+// StorageRead is a storage slot a transaction read, with its value.
+type StorageRead struct {
+	Slot  common.Hash
+	Value common.Hash
+}
+
+type accountState struct {
+	balance  *big.Int
+	nonce    uint64
+	codeHash common.Hash
+	storage  map[common.Hash]common.Hash
+	read     map[common.Hash]bool
+}
+
+// StateDiffTracer records, per transaction, the accounts and storage slots
+// it changed, and the slots it read. It follows the diff mode of the native
+// prestateTracer and, like CallTracer, can stay installed for a whole block.
+type StateDiffTracer struct {
+	env       *vm.EVM
+	pre       map[common.Address]*accountState
+	gasLimit  uint64
+	diffs     []*TxStateDiff
+	interrupt uint32 // Atomic flag to signal execution interruption
+	reason    error  // Textual reason for the interruption
+}
+
+var _ vm.EVMLogger = &StateDiffTracer{}
+
+func NewStateDiffTracer() *StateDiffTracer {
+	return &StateDiffTracer{pre: make(map[common.Address]*accountState)}
+}
+
+func (t *StateDiffTracer) CaptureTxStart(gasLimit uint64) {
+	t.gasLimit = gasLimit
+	t.pre = make(map[common.Address]*accountState)
+}
+
+// CaptureStart is called after the sender was charged and the value was
+// transferred, so those are reverted to get the pre-transaction balances.
+func (t *StateDiffTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+	t.env = env
+
+	t.lookupAccount(from)
+	t.lookupAccount(to)
+	t.lookupAccount(env.Context.Coinbase)
+
+	if value == nil {
+		value = new(big.Int)
+	}
+	// The recipient balance includes the value transferred.
+	t.pre[to].balance = new(big.Int).Sub(t.pre[to].balance, value)
+
+	// The sender balance is after reducing: value and gasLimit.
+	gasPrice := env.TxContext.GasPrice
+	consumedGas := new(big.Int).Mul(gasPrice, new(big.Int).SetUint64(t.gasLimit))
+	fromBal := new(big.Int).Set(t.pre[from].balance)
+	t.pre[from].balance = fromBal.Add(fromBal, new(big.Int).Add(value, consumedGas))
+	t.pre[from].nonce--
+}
+
+func (t *StateDiffTracer) CaptureEnd(output []byte, gasUsed uint64, err error) {}
+
+// CaptureState collects the accounts and slots the transaction touches.
+func (t *StateDiffTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+	if err != nil || atomic.LoadUint32(&t.interrupt) > 0 {
+		return
+	}
+	stackData := scope.Stack.Data()
+	stackLen := len(stackData)
+	caller := scope.Contract.Address()
+	switch {
+	case stackLen >= 1 && op == vm.SLOAD:
+		slot := common.Hash(stackData[stackLen-1].Bytes32())
+		t.lookupAccount(caller)
+		t.lookupStorage(caller, slot)
+		t.pre[caller].read[slot] = true
+	case stackLen >= 1 && op == vm.SSTORE:
+		t.lookupAccount(caller)
+		t.lookupStorage(caller, common.Hash(stackData[stackLen-1].Bytes32()))
+	case stackLen >= 1 && op == vm.SELFDESTRUCT:
+		t.lookupAccount(caller)
+		t.lookupAccount(common.Address(stackData[stackLen-1].Bytes20()))
+	case stackLen >= 5 && (op == vm.CALL || op == vm.CALLCODE):
+		t.lookupAccount(common.Address(stackData[stackLen-2].Bytes20()))
+	case op == vm.CREATE:
+		t.lookupAccount(crypto.CreateAddress(caller, t.env.StateDB.GetNonce(caller)))
+		t.lookupAccount(caller)
+	case stackLen >= 4 && op == vm.CREATE2:
+		offset, size := stackData[stackLen-2], stackData[stackLen-3]
+		if !offset.IsUint64() || !size.IsUint64() || offset.Uint64()+size.Uint64() > uint64(scope.Memory.Len()) {
+			return
+		}
+		initHash := crypto.Keccak256(scope.Memory.GetPtr(int64(offset.Uint64()), int64(size.Uint64())))
+		salt := stackData[stackLen-4]
+		t.lookupAccount(crypto.CreateAddress2(caller, salt.Bytes32(), initHash))
+		t.lookupAccount(caller)
+	}
+}
+
+func (t *StateDiffTracer) CaptureFault(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, depth int, err error) {
+}
+
+func (t *StateDiffTracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+}
+
+func (t *StateDiffTracer) CaptureExit(output []byte, gasUsed uint64, err error) {}
+
+// CaptureTxEnd runs after the refund and the fee payment, so the state read
+// here is the post-transaction state.
+func (t *StateDiffTracer) CaptureTxEnd(restGas uint64) {
+	if t.env == nil || len(t.pre) == 0 {
+		return
+	}
+	diff := &TxStateDiff{}
+	if txState, ok := t.env.StateDB.(interface{ TxIndex() int }); ok {
+		diff.TxIndex = uint32(txState.TxIndex())
+	}
+	for addr, pre := range t.pre {
+		account := AccountDiff{
+			Address:        addr,
+			BalanceBefore:  pre.balance,
+			BalanceAfter:   new(big.Int).Set(t.env.StateDB.GetBalance(addr)),
+			NonceBefore:    pre.nonce,
+			NonceAfter:     t.env.StateDB.GetNonce(addr),
+			CodeHashBefore: pre.codeHash,
+			CodeHashAfter:  t.codeHash(addr),
+		}
+		for slot, before := range pre.storage {
+			if after := t.env.StateDB.GetState(addr, slot); after != before {
+				account.Storage = append(account.Storage, StorageDiff{Slot: slot, Before: before, After: after})
+			} else if pre.read[slot] {
+				account.Read = append(account.Read, StorageRead{Slot: slot, Value: before})
+			}
+		}
+		if account.BalanceBefore.Cmp(account.BalanceAfter) == 0 && account.NonceBefore == account.NonceAfter &&
+			account.CodeHashBefore == account.CodeHashAfter && len(account.Storage) == 0 && len(account.Read) == 0 {
+			continue
+		}
+		sort.Slice(account.Storage, func(i, j int) bool {
+			return bytes.Compare(account.Storage[i].Slot[:], account.Storage[j].Slot[:]) < 0
+		})
+		sort.Slice(account.Read, func(i, j int) bool {
+			return bytes.Compare(account.Read[i].Slot[:], account.Read[j].Slot[:]) < 0
+		})
+		diff.Accounts = append(diff.Accounts, account)
+	}
+	sort.Slice(diff.Accounts, func(i, j int) bool {
+		return bytes.Compare(diff.Accounts[i].Address[:], diff.Accounts[j].Address[:]) < 0
+	})
+	t.diffs = append(t.diffs, diff)
+	t.pre = make(map[common.Address]*accountState)
+}
+
+// TakeResult returns the state diffs of all transactions traced since the
+// last call, and any error arising from forceful termination (via `Stop`).
+func (t *StateDiffTracer) TakeResult() ([]*TxStateDiff, error) {
+	defer func() {
+		t.diffs = nil
+		t.pre = make(map[common.Address]*accountState)
+		atomic.StoreUint32(&t.interrupt, 0)
+		t.reason = nil
+	}()
+
+	return t.diffs, t.reason
+}
+
+// TakeBlockResult is TakeResult that also sets the transaction hashes, see
+// CallTracer.TakeBlockResult.
+func (t *StateDiffTracer) TakeBlockResult(txs types.Transactions) ([]*TxStateDiff, error) {
+	diffs, err := t.TakeResult()
+	for _, diff := range diffs {
+		if int(diff.TxIndex) < len(txs) {
+			diff.TxHash = txs[diff.TxIndex].Hash().String()
+		}
+	}
+
+	return diffs, err
+}
+
+// Stop terminates execution of the tracer at the first opportune moment.
+func (t *StateDiffTracer) Stop(err error) {
+	t.reason = err
+	atomic.StoreUint32(&t.interrupt, 1)
+}
+
+// lookupAccount records the current state of addr unless it is known already.
+func (t *StateDiffTracer) lookupAccount(addr common.Address) {
+	if _, ok := t.pre[addr]; ok {
+		return
+	}
+	t.pre[addr] = &accountState{
+		balance:  new(big.Int).Set(t.env.StateDB.GetBalance(addr)),
+		nonce:    t.env.StateDB.GetNonce(addr),
+		codeHash: t.codeHash(addr),
+		storage:  make(map[common.Hash]common.Hash),
+		read:     make(map[common.Hash]bool),
+	}
+}
+
+// codeHash returns the code hash of addr, reporting missing accounts as
+// accounts without code.
+func (t *StateDiffTracer) codeHash(addr common.Address) common.Hash {
+	if hash := t.env.StateDB.GetCodeHash(addr); hash != (common.Hash{}) {
+		return hash
+	}
+	return types.EmptyCodeHash
+}
+
+// lookupStorage records the current value of a slot of addr unless it is
+// known already. It assumes lookupAccount was called for addr.
+func (t *StateDiffTracer) lookupStorage(addr common.Address, slot common.Hash) {
+	if _, ok := t.pre[addr].storage[slot]; ok {
+		return
+	}
+	t.pre[addr].storage[slot] = t.env.StateDB.GetState(addr, slot)
+}
@@ -0,0 +1,111 @@
+package mamoru
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateDiffTracer(t *testing.T) {
+	env := newCallEnv(t)
+	var (
+		to    = common.HexToAddress("0xdead")
+		store = common.HexToAddress("0xa0")
+	)
+	// sstore(1, 42)
+	env.statedb.SetCode(store, []byte{byte(vm.PUSH1), 42, byte(vm.PUSH1), 1, byte(vm.SSTORE), byte(vm.STOP)})
+
+	txs := types.Transactions{env.tx(&to, big.NewInt(7), nil), env.tx(&store, nil, nil)}
+	senderBalance := new(big.Int).Set(env.statedb.GetBalance(env.sender()))
+
+	callTracer, stateTracer := NewCallTracer(false), NewStateDiffTracer()
+	receipts := env.apply(NewMuxTracer(callTracer, stateTracer), txs)
+
+	diffs, err := stateTracer.TakeBlockResult(txs)
+	require.NoError(t, err)
+	require.Len(t, diffs, 2)
+
+	// Value transfer: sender, recipient and the zero-address coinbase
+	transfer := diffs[0]
+	assert.Equal(t, uint32(0), transfer.TxIndex)
+	assert.Equal(t, txs[0].Hash().String(), transfer.TxHash)
+	accounts := make(map[common.Address]AccountDiff)
+	for _, account := range transfer.Accounts {
+		accounts[account.Address] = account
+	}
+	require.Len(t, accounts, 3)
+
+	sender := accounts[env.sender()]
+	assert.Equal(t, senderBalance, sender.BalanceBefore)
+	gasPrice := new(big.Int).Add(env.header.BaseFee, txs[0].GasTipCap())
+	paid := new(big.Int).Mul(gasPrice, new(big.Int).SetUint64(receipts[0].GasUsed))
+	assert.Equal(t, new(big.Int).Sub(senderBalance, paid.Add(paid, big.NewInt(7))), sender.BalanceAfter)
+	assert.Equal(t, []uint64{0, 1}, []uint64{sender.NonceBefore, sender.NonceAfter})
+
+	recipient := accounts[to]
+	assert.Equal(t, int64(0), recipient.BalanceBefore.Int64())
+	assert.Equal(t, int64(7), recipient.BalanceAfter.Int64())
+	assert.Equal(t, types.EmptyCodeHash, recipient.CodeHashBefore)
+	assert.Empty(t, recipient.Storage)
+
+	// Storage write
+	var written *AccountDiff
+	for i := range diffs[1].Accounts {
+		if diffs[1].Accounts[i].Address == store {
+			written = &diffs[1].Accounts[i]
+		}
+	}
+	require.NotNil(t, written)
+	assert.Equal(t, []StorageDiff{{
+		Slot:   common.BigToHash(big.NewInt(1)),
+		Before: common.Hash{},
+		After:  common.BigToHash(big.NewInt(42)),
+	}}, written.Storage)
+
+	stateDiffs := NewFeed(params.TestChainConfig).FeedStateDiffs(diffs, 1)
+	assert.Len(t, stateDiffs, len(diffs[0].Accounts)+len(diffs[1].Accounts))
+	assert.Equal(t, txs[1].Hash().String(), stateDiffs[len(stateDiffs)-1].TxHash)
+	assert.Equal(t, uint32(1), stateDiffs[len(stateDiffs)-1].TxIndex)
+
+	// The call tracer saw the same execution
+	frames, err := callTracer.TakeBlockResult(txs)
+	require.NoError(t, err)
+	assert.Len(t, frames, 2)
+}
+
+func TestStateDiffTracer_Read(t *testing.T) {
+	env := newCallEnv(t)
+	reader := common.HexToAddress("0xa1")
+	// sload(1), sload(2), sstore(2, 7)
+	env.statedb.SetCode(reader, []byte{
+		byte(vm.PUSH1), 1, byte(vm.SLOAD), byte(vm.POP),
+		byte(vm.PUSH1), 2, byte(vm.SLOAD), byte(vm.POP),
+		byte(vm.PUSH1), 7, byte(vm.PUSH1), 2, byte(vm.SSTORE), byte(vm.STOP),
+	})
+	env.statedb.SetState(reader, common.BigToHash(big.NewInt(1)), common.BigToHash(big.NewInt(5)))
+
+	txs := types.Transactions{env.tx(&reader, nil, nil)}
+	stateTracer := NewStateDiffTracer()
+	env.apply(stateTracer, txs)
+
+	diffs, err := stateTracer.TakeBlockResult(txs)
+	require.NoError(t, err)
+	require.Len(t, diffs, 1)
+	var account *AccountDiff
+	for i := range diffs[0].Accounts {
+		if diffs[0].Accounts[i].Address == reader {
+			account = &diffs[0].Accounts[i]
+		}
+	}
+	require.NotNil(t, account)
+	// The slot read and written is a change, the other one a read
+	assert.Equal(t, []StorageRead{{Slot: common.BigToHash(big.NewInt(1)), Value: common.BigToHash(big.NewInt(5))}}, account.Read)
+	require.Len(t, account.Storage, 1)
+	assert.Equal(t, common.BigToHash(big.NewInt(2)), account.Storage[0].Slot)
+}
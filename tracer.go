@@ -1,11 +1,13 @@
 package mamoru
 
 import (
+	"errors"
 	"math/big"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/Mamoru-Foundation/mamoru-sniffer-go/mamoru_sniffer"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/log"
@@ -16,63 +18,256 @@ const (
 	CtxLightchain  = "lightchain"
 	CtxLightTxpool = "lighttxpool"
 	CtxTxpool      = "txpool"
+	CtxBackfill    = "backfill"
+	CtxReorg       = "reorg"
+)
+
+const (
+	// BlockStatusIncomplete is the status of a block sent with parts of its
+	// data missing, see Tracer.MarkIncomplete.
+	BlockStatusIncomplete = "incomplete"
+	// BlockStatusDiverged is the status of a block whose replay doesn't
+	// match the chain, see Tracer.MarkDiverged.
+	BlockStatusDiverged = "diverged"
+
+	// The statuses below tag how a block was sent. They are combined with
+	// the statuses above, comma separated, e.g. "backfill,incomplete".
+
+	// BlockStatusBackfill is the status of a block sent after the fact by a
+	// backfill, see Tracer.SetBackfillCtx.
+	BlockStatusBackfill = "backfill"
+	// BlockStatusRetracted is the status of a block sent again to retract
+	// it, as a reorg dropped it from the canonical chain, see
+	// Tracer.MarkRetracted.
+	BlockStatusRetracted = "retracted"
+	// BlockStatusReorg is the status of the blocks a reorg dropped or added,
+	// followed by its depth, e.g. "reorg=2", see Tracer.SetReorgDepth.
+	BlockStatusReorg = "reorg"
 )
 
 type Tracer struct {
-	feeder  Feeder
-	mu      sync.Mutex
-	builder mamoru_sniffer.EvmCtxBuilder
+	feeder     Feeder
+	mu         sync.Mutex
+	data       EvmCtx
+	sink       Sink
+	incomplete []string
+	diverged   []string
+	backfill   bool
+	retracted  bool
+	reorgDepth uint64
+	deliveries *Deliveries
+	addresses  map[string]bool
+}
+
+// TracerOption customizes a Tracer.
+type TracerOption func(*Tracer)
+
+// WithTracerConfig applies the filters of cfg to the blocks sent. A nil cfg
+// is ignored, e.g. the config of a Sniffer without one.
+func WithTracerConfig(cfg *Config) TracerOption {
+	return func(t *Tracer) {
+		if cfg == nil || len(cfg.Filters.Addresses) == 0 {
+			return
+		}
+		t.addresses = make(map[string]bool, len(cfg.Filters.Addresses))
+		for _, address := range cfg.Filters.Addresses {
+			t.addresses[strings.ToLower(address.Hex())] = true
+		}
+	}
 }
 
-func NewTracer(feeder Feeder) *Tracer {
-	builder := mamoru_sniffer.NewEvmCtxBuilder()
-	tr := &Tracer{builder: builder, feeder: feeder}
+func NewTracer(feeder Feeder, opts ...TracerOption) *Tracer {
+	tr := &Tracer{feeder: feeder, sink: defaultSink, deliveries: DefaultDeliveries}
+	for _, opt := range opts {
+		opt(tr)
+	}
 	return tr
 }
 
-func (t *Tracer) FeedBlock(block *types.Block) {
+// SetSink sets the Sink Send hands the block over to, the validation chain
+// by default, see Sniffer.Sink.
+func (t *Tracer) SetSink(sink Sink) {
 	defer t.mu.Unlock()
 	t.mu.Lock()
-	t.builder.SetBlock(
-		t.feeder.FeedBlock(block),
-	)
+	t.sink = sink
+}
+
+// SetDeliveries sets the Deliveries Send skips the blocks already sent with,
+// DefaultDeliveries by default. Every block is sent if deliveries is nil.
+func (t *Tracer) SetDeliveries(deliveries *Deliveries) {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+	t.deliveries = deliveries
+}
+
+func (t *Tracer) FeedBlock(block *types.Block, receipts types.Receipts) {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+	blockData := t.feeder.FeedBlock(block, receipts)
+	t.data.Block = &blockData
 }
 
-func (t *Tracer) FeedTransactions(blockNumber *big.Int, blockTime uint64, txs types.Transactions, receipts types.Receipts) {
+func (t *Tracer) FeedTransactions(blockNumber *big.Int, blockTime uint64, baseFee *big.Int, txs types.Transactions, receipts types.Receipts) {
 	defer t.mu.Unlock()
 	t.mu.Lock()
-	t.builder.AppendTxs(
-		t.feeder.FeedTransactions(blockNumber, blockTime, txs, receipts),
+	t.data.Transactions = append(t.data.Transactions,
+		t.feeder.FeedTransactions(blockNumber, blockTime, baseFee, txs, receipts)...,
 	)
 }
 
 func (t *Tracer) FeedEvents(receipts types.Receipts) {
 	defer t.mu.Unlock()
 	t.mu.Lock()
-	t.builder.AppendEvents(
-		t.feeder.FeedEvents(receipts),
+	t.data.Events = append(t.data.Events,
+		t.feeder.FeedEvents(receipts)...,
 	)
 }
 
 func (t *Tracer) FeedCalTraces(callFrames []*CallFrame, blockNumber uint64) {
 	defer t.mu.Unlock()
 	t.mu.Lock()
-	t.builder.AppendCallTraces(
-		t.feeder.FeedCallTraces(callFrames, blockNumber),
+	t.data.CallTraces = append(t.data.CallTraces,
+		t.feeder.FeedCallTraces(callFrames, blockNumber)...,
+	)
+}
+
+// FeedWithdrawals appends the block's withdrawals. They are sent to the
+// validation chain as call traces of type CallTypeWithdrawal.
+func (t *Tracer) FeedWithdrawals(withdrawals types.Withdrawals, blockNumber uint64) {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+	t.data.Withdrawals = append(t.data.Withdrawals,
+		t.feeder.FeedWithdrawals(withdrawals, blockNumber)...,
 	)
 }
 
+// FeedStateDiffs appends per-transaction state changes. They are sent to the
+// sinks, but not to the validation chain, which has no slot for them.
+func (t *Tracer) FeedStateDiffs(diffs []*TxStateDiff, blockNumber uint64) {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+	t.data.StateDiffs = append(t.data.StateDiffs, t.feeder.FeedStateDiffs(diffs, blockNumber)...)
+}
+
+// StateDiffs returns the state changes fed so far.
+func (t *Tracer) StateDiffs() []StateDiff {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+	return t.data.StateDiffs
+}
+
+// MarkIncomplete records that some of the data could not be collected, e.g. a
+// transaction that could not be traced. The data is still sent, with the
+// block status set to BlockStatusIncomplete.
+func (t *Tracer) MarkIncomplete(reason string) {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+	t.incomplete = append(t.incomplete, reason)
+}
+
+// Incomplete returns the reasons passed to MarkIncomplete.
+func (t *Tracer) Incomplete() []string {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+	return t.incomplete
+}
+
+// MarkDiverged records that the replayed block doesn't match the chain, so
+// its traces can't be trusted. The data is still sent, with the block status
+// set to BlockStatusDiverged.
+func (t *Tracer) MarkDiverged(reason string) {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+	t.diverged = append(t.diverged, reason)
+}
+
+// Diverged returns the reasons passed to MarkDiverged.
+func (t *Tracer) Diverged() []string {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+	return t.diverged
+}
+
 func (t *Tracer) SetTxpoolCtx() {
-	t.builder.SetMempoolSource()
+	defer t.mu.Unlock()
+	t.mu.Lock()
+	t.data.Mempool = true
+}
+
+// SetBackfillCtx tags the block as backfilled, i.e. sent behind the chain
+// head rather than as it was imported.
+func (t *Tracer) SetBackfillCtx() {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+	t.backfill = true
+}
+
+// MarkRetracted turns the block into a retraction notice: a reorg dropped it
+// from the canonical chain, the data sent for it before is no longer valid.
+func (t *Tracer) MarkRetracted() {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+	t.retracted = true
+}
+
+// SetReorgDepth tags the block as dropped or added by a reorg of depth
+// blocks.
+func (t *Tracer) SetReorgDepth(depth uint64) {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+	t.reorgDepth = depth
+}
+
+// Status returns the block status Send sets from the marks and tags.
+func (t *Tracer) Status() string {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+	return t.blockStatus()
 }
 
-func (t *Tracer) Send(start time.Time, blockNumber *big.Int, blockHash common.Hash, snifferContext string) {
+// Send hands the block over to the sink, unless it was sent already in
+// snifferContext, see Deliveries. It returns the error of the sink, or
+// ErrNotConnected without one; nil means the block is delivered.
+func (t *Tracer) Send(start time.Time, blockNumber *big.Int, blockHash common.Hash, snifferContext string) error {
 	defer t.mu.Unlock()
 	t.mu.Lock()
 
-	if sniffer != nil {
-		t.builder.SetBlockData(blockNumber.String(), blockHash.String())
-		sniffer.ObserveEvmData(t.builder.Finish())
+	key := deliveryKey(snifferContext, t.retracted)
+	deliveries := t.deliveries
+	if key == "" {
+		deliveries = nil
+	}
+	if deliveries != nil && !deliveries.claim(blockHash, key) {
+		log.Info("Mamoru Sniffer skip delivered", "number", blockNumber, "hash", blockHash, "ctx", snifferContext)
+		return nil
+	}
+	if status := t.status(); status != "" {
+		log.Warn("Mamoru Sniffer untrusted data", "status", status, "number", blockNumber, "hash", blockHash,
+			"incomplete", t.incomplete, "diverged", t.diverged, "ctx", snifferContext)
+	}
+	if status := t.blockStatus(); status != "" && t.data.Block != nil {
+		t.data.Block.Status = status
+	}
+	t.data.Context = snifferContext
+	t.data.BlockNumber = blockNumber
+	t.data.BlockHash = blockHash
+	if t.addresses != nil {
+		t.filter()
+	}
+
+	err := ErrNotConnected
+	if t.sink != nil {
+		err = t.sink.Send(&t.data)
+	}
+	if deliveries != nil {
+		if err == nil {
+			deliveries.acknowledge(blockHash, key)
+		} else {
+			deliveries.release(blockHash, key)
+		}
+	}
+	if err != nil && !errors.Is(err, ErrNotConnected) {
+		log.Error("Mamoru Sniffer send", "number", blockNumber, "hash", blockHash, "err", err, "ctx", snifferContext)
 	}
 	logCtx := []interface{}{
 		"elapsed", common.PrettyDuration(time.Since(start)),
@@ -81,4 +276,88 @@ func (t *Tracer) Send(start time.Time, blockNumber *big.Int, blockHash common.Ha
 		"ctx", snifferContext,
 	}
 	log.Info("Mamoru Sniffer finish", logCtx...)
+
+	return err
+}
+
+// filter keeps the transactions, events, call traces, withdrawals and state
+// diffs involving the addresses of the filter.
+func (t *Tracer) filter() {
+	involved := func(addresses ...string) bool {
+		for _, address := range addresses {
+			if t.addresses[strings.ToLower(address)] {
+				return true
+			}
+		}
+		return false
+	}
+	txs := t.data.Transactions[:0]
+	for _, tx := range t.data.Transactions {
+		if involved(tx.From, tx.To) {
+			txs = append(txs, tx)
+		}
+	}
+	t.data.Transactions = txs
+
+	events := t.data.Events[:0]
+	for _, event := range t.data.Events {
+		if involved(event.Address) {
+			events = append(events, event)
+		}
+	}
+	t.data.Events = events
+
+	calls := t.data.CallTraces[:0]
+	for _, call := range t.data.CallTraces {
+		if involved(call.From, call.To) {
+			calls = append(calls, call)
+		}
+	}
+	t.data.CallTraces = calls
+
+	withdrawals := t.data.Withdrawals[:0]
+	for _, withdrawal := range t.data.Withdrawals {
+		if involved(withdrawal.Address) {
+			withdrawals = append(withdrawals, withdrawal)
+		}
+	}
+	t.data.Withdrawals = withdrawals
+
+	diffs := t.data.StateDiffs[:0]
+	for _, diff := range t.data.StateDiffs {
+		if involved(diff.Address) {
+			diffs = append(diffs, diff)
+		}
+	}
+	t.data.StateDiffs = diffs
+}
+
+// blockStatus combines the tags with the status from the marks.
+func (t *Tracer) blockStatus() string {
+	var statuses []string
+	if t.backfill {
+		statuses = append(statuses, BlockStatusBackfill)
+	}
+	if t.retracted {
+		statuses = append(statuses, BlockStatusRetracted)
+	}
+	if t.reorgDepth > 0 {
+		statuses = append(statuses, BlockStatusReorg+"="+strconv.FormatUint(t.reorgDepth, 10))
+	}
+	if status := t.status(); status != "" {
+		statuses = append(statuses, status)
+	}
+	return strings.Join(statuses, ",")
+}
+
+// status returns the block status from the marks, a divergence outweighing
+// missing data.
+func (t *Tracer) status() string {
+	switch {
+	case len(t.diverged) > 0:
+		return BlockStatusDiverged
+	case len(t.incomplete) > 0:
+		return BlockStatusIncomplete
+	}
+	return ""
 }
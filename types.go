@@ -0,0 +1,196 @@
+package mamoru
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+
+	"github.com/Mamoru-Foundation/mamoru-sniffer-go/mamoru_sniffer"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// BigInt is a lossless 256-bit value used for wei-denominated fields.
+// It encodes as a decimal string in text formats (JSON, TOML).
+type BigInt big.Int
+
+// NewBigInt copies x into a BigInt. A nil x yields nil.
+func NewBigInt(x *big.Int) *BigInt {
+	if x == nil {
+		return nil
+	}
+	return (*BigInt)(new(big.Int).Set(x))
+}
+
+// Big returns the value as *big.Int. A nil receiver yields zero.
+func (b *BigInt) Big() *big.Int {
+	if b == nil {
+		return new(big.Int)
+	}
+	return new(big.Int).Set((*big.Int)(b))
+}
+
+// String returns the decimal representation of the value.
+func (b *BigInt) String() string {
+	return b.Big().String()
+}
+
+// Bytes32 returns the value as a 32-byte big-endian word.
+func (b *BigInt) Bytes32() []byte {
+	word := make([]byte, 32)
+	return b.Big().FillBytes(word)
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (b *BigInt) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (b *BigInt) UnmarshalText(text []byte) error {
+	x, ok := new(big.Int).SetString(string(text), 10)
+	if !ok {
+		return fmt.Errorf("invalid decimal integer %q", text)
+	}
+	*b = BigInt(*x)
+	return nil
+}
+
+// Block is a block header as produced by a Feeder. BlockReward in the wire
+// struct holds the big-endian total reward.
+type Block struct {
+	mamoru_sniffer.Block
+
+	DifficultyBig      *BigInt
+	TotalDifficultyBig *BigInt // nil when the chain is not known to the feed
+	PostMerge          bool    // set for beacon chain blocks, where difficulty is no longer meaningful
+	BaseFeeBig         *BigInt
+	MixDigest          string // prevRandao after the merge
+	ExtraData          []byte
+	TxCount            uint32
+	UncleCount         uint32
+	BlockRewardBig     *BigInt // StaticRewardBig + PriorityFeesBig
+	StaticRewardBig    *BigInt
+	PriorityFeesBig    *BigInt
+}
+
+// Transaction is a transaction as produced by a Feeder. The embedded wire
+// struct is what the validation chain receives; the Big fields carry the
+// same wei amounts without truncation.
+type Transaction struct {
+	mamoru_sniffer.Transaction
+
+	ValueBig       *BigInt
+	FeeBig         *BigInt // total fee paid: gas used × effective gas price
+	GasPriceBig    *BigInt // effective gas price
+	GasFeeCapBig   *BigInt
+	GasTipCapBig   *BigInt
+	PriorityFeeBig *BigInt // tip paid to the fee recipient
+	BurntFeeBig    *BigInt // base fee burnt
+}
+
+// CallTrace is a call frame as produced by a Feeder.
+type CallTrace struct {
+	mamoru_sniffer.CallTrace
+
+	TxHash       string
+	ParentSeq    int // Seq of the calling frame, -1 for the top call
+	TraceAddress []uint32
+	ValueBig     *BigInt
+	Output       string
+	Error        string
+	Reverted     bool
+	Revert       *Revert
+	Logs         []CallLog
+	Storage      []StorageAccess
+}
+
+// StateDiff is the change a transaction made to one account, as produced by
+// a Feeder.
+type StateDiff struct {
+	BlockIndex       uint64
+	TxIndex          uint32
+	TxHash           string
+	Address          string
+	BalanceBeforeBig *BigInt
+	BalanceAfterBig  *BigInt
+	NonceBefore      uint64
+	NonceAfter       uint64
+	CodeHashBefore   string
+	CodeHashAfter    string
+	Storage          []StorageDiff
+	Read             []StorageRead
+}
+
+// WithdrawalTxIndex is the TxIndex of withdrawal call traces. Withdrawals are
+// block-level balance credits and do not belong to any transaction.
+const WithdrawalTxIndex = math.MaxUint32
+
+// CallTypeWithdrawal is the call trace type withdrawals are sent as, in the
+// spirit of the "reward" traces of the trace_ RPC namespace.
+const CallTypeWithdrawal = "WITHDRAWAL"
+
+// Withdrawal is a beacon chain withdrawal (EIP-4895) as produced by a Feeder.
+type Withdrawal struct {
+	Index          uint64
+	ValidatorIndex uint64
+	BlockIndex     uint64
+	Address        string
+	Amount         uint64  // in gwei, as in the consensus layer
+	AmountBig      *BigInt // in wei
+	Value          uint64  // in wei, narrowed as the other values, see toUint64
+}
+
+// callTrace represents the withdrawal on the wire, which has no dedicated
+// slot for it, as a value transfer from the zero address. Like the other
+// call traces, the value is in wei.
+func (w Withdrawal) callTrace(seq uint32) mamoru_sniffer.CallTrace {
+	return mamoru_sniffer.CallTrace{
+		Seq:        seq,
+		TxIndex:    WithdrawalTxIndex,
+		BlockIndex: w.BlockIndex,
+		Type:       CallTypeWithdrawal,
+		From:       common.Address{}.String(),
+		To:         w.Address,
+		Value:      w.Value,
+	}
+}
+
+// toUint64 narrows a wei amount to the uint64 wire fields. By default the
+// value saturates at math.MaxUint64 so large amounts never look small;
+// legacy mode keeps the historical wrap-around of big.Int.Uint64.
+func toUint64(x *big.Int, legacy bool) uint64 {
+	if x == nil {
+		return 0
+	}
+	if legacy || x.IsUint64() {
+		return x.Uint64()
+	}
+	if x.Sign() < 0 {
+		return 0
+	}
+	return math.MaxUint64
+}
+
+func wireTransactions(txs []Transaction) []mamoru_sniffer.Transaction {
+	out := make([]mamoru_sniffer.Transaction, 0, len(txs))
+	for _, tx := range txs {
+		out = append(out, tx.Transaction)
+	}
+	return out
+}
+
+func wireWithdrawals(withdrawals []Withdrawal) []mamoru_sniffer.CallTrace {
+	out := make([]mamoru_sniffer.CallTrace, 0, len(withdrawals))
+	for i, w := range withdrawals {
+		out = append(out, w.callTrace(uint32(i)))
+	}
+	return out
+}
+
+func wireCallTraces(traces []CallTrace) []mamoru_sniffer.CallTrace {
+	out := make([]mamoru_sniffer.CallTrace, 0, len(traces))
+	for _, trace := range traces {
+		out = append(out, trace.CallTrace)
+	}
+	return out
+}